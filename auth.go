@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/drone/config"
+	"github.com/zenazn/goji/web"
+)
+
+var (
+	AuthApiKeys      = config.String("auth-api-keys", "")
+	AuthJwtSecret    = config.String("auth-jwt-secret", "")
+	AuthJwksFile     = config.String("auth-jwks-file", "")
+	AuthJwtIssuer    = config.String("auth-jwt-issuer", "")
+	AuthJwtAud       = config.String("auth-jwt-audience", "")
+	AuthWriteScope   = config.String("auth-write-scope", "")
+	AuthPublicRead   = config.Bool("auth-public-read", true)
+	AuthDisabled     = config.Bool("auth-disabled", false)
+	AuthServiceCerts = config.String("auth-service-certs", "")
+)
+
+// Key of the authenticated Principal in the request environment.
+const PrincipalEnvKey = "principal"
+
+// Allowed clock difference for "exp" and "nbf" claims.
+const jwtLeeway = 30 * time.Second
+
+var (
+	errNoCredentials = errors.New(`authorization required`)
+	errInvalidApiKey = errors.New(`invalid api key`)
+	errInvalidToken  = errors.New(`invalid token`)
+	errExpiredToken  = errors.New(`token is expired`)
+	errNoAuthConfig  = errors.New(`no credentials are configured, set "auth-disabled" to run without authentication`)
+)
+
+// Authentication settings loaded from the configuration.
+type authConfig struct {
+	apiKeys      []string
+	clientCerts  bool
+	serviceCerts []string
+	secret       []byte
+	rsaKeys      map[string]*rsa.PublicKey
+	issuer       string
+	audience     string
+}
+
+var auth = &authConfig{}
+
+// Principal is the authenticated client of the request.
+type Principal struct {
+	Subject    string
+	Scopes     []string
+	Claims     map[string]interface{}
+	ApiKey     bool
+	ClientCert bool
+	// The client certificate is allowed to act as a service.
+	ServiceCert bool
+}
+
+// Check whether the principal has the scope.
+func (p *Principal) HasScope(scope string) bool {
+	return contains(p.Scopes, scope)
+}
+
+// Check whether the principal is a service authenticated by API key or
+// client certificate of "auth-service-certs" rather than a user. Services
+// may modify any avatar.
+func (p *Principal) IsService() bool {
+	return p.ApiKey || p.ServiceCert
+}
+
+// Load authentication settings. Should be called after the configuration
+// is parsed. Fails if no credentials are configured unless authentication
+// is disabled explicitly by "auth-disabled".
+func initAuth() error {
+	a := &authConfig{
+		apiKeys:      splitList(*AuthApiKeys),
+		clientCerts:  *TlsClientCaFile != "",
+		serviceCerts: splitList(*AuthServiceCerts),
+		secret:       []byte(*AuthJwtSecret),
+		issuer:       *AuthJwtIssuer,
+		audience:     *AuthJwtAud,
+	}
+	if *AuthJwksFile != "" {
+		data, err := ioutil.ReadFile(*AuthJwksFile)
+		if err != nil {
+			return err
+		}
+		if a.rsaKeys, err = parseJwks(data); err != nil {
+			return err
+		}
+	}
+	if !a.enabled() && !*AuthDisabled {
+		return errNoAuthConfig
+	}
+	auth = a
+
+	if policy, ok := WritePolicy.(*OwnerPolicy); ok {
+		policy.AdminScope = *AuthAdminScope
+	}
+	return nil
+}
+
+// Check whether the certificate is listed in "auth-service-certs" by its
+// common name or any of DNS names and emails.
+func (a *authConfig) isServiceCert(cert *x509.Certificate) bool {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, name := range append(names, cert.EmailAddresses...) {
+		if name != "" && contains(a.serviceCerts, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether any credentials are configured.
+func (a *authConfig) enabled() bool {
+	return len(a.apiKeys) > 0 || len(a.secret) > 0 || len(a.rsaKeys) > 0 || a.clientCerts
+}
+
+// Authenticate the request by "api_key" header, "Authorization: Bearer"
+// JWT or verified TLS client certificate. Reading methods are public unless
+// "auth-public-read" is disabled. Authentication is off if "auth-disabled"
+// is set.
+func Auth(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.enabled() || (*AuthPublicRead && isReadRequest(r)) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := auth.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="avatars"`)
+			JsonResponseMsg(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if *AuthWriteScope != "" && !isReadRequest(r) && !principal.IsService() && !principal.HasScope(*AuthWriteScope) {
+			JsonResponseMsg(w, http.StatusForbidden, `token has no "`+*AuthWriteScope+`" scope`)
+			return
+		}
+
+		if c.Env == nil {
+			c.Env = make(map[interface{}]interface{})
+		}
+		c.Env[PrincipalEnvKey] = principal
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Get the authenticated principal of the request if any.
+func GetPrincipal(c web.C) *Principal {
+	principal, _ := c.Env[PrincipalEnvKey].(*Principal)
+	return principal
+}
+
+func isReadMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// Check if the request only reads avatars. The bulk lookup is sent by POST
+// but is a read.
+func isReadRequest(r *http.Request) bool {
+	return isReadMethod(r.Method) || (r.Method == "POST" && r.URL.Path == BatchGetUrl)
+}
+
+func (a *authConfig) authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get("api_key"); key != "" {
+		for _, apiKey := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+				// the key itself is secret, its hash identifies the client
+				hash := sha256.Sum256([]byte(key))
+				return &Principal{Subject: "api-key:" + hex.EncodeToString(hash[:6]), ApiKey: true}, nil
+			}
+		}
+		return nil, errInvalidApiKey
+	}
+
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return a.verifyToken(strings.TrimSpace(header[7:]), time.Now())
+	}
+	if cert := clientCertificate(r); cert != nil && a.clientCerts {
+		return &Principal{Subject: "cert:" + cert.Subject.CommonName, ClientCert: true, ServiceCert: a.isServiceCert(cert)}, nil
+	}
+	return nil, errNoCredentials
+}
+
+// Verify the signature and the registered claims of the JWT.
+func (a *authConfig) verifyToken(token string, now time.Time) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case "HS256":
+		if len(a.secret) == 0 {
+			return nil, errInvalidToken
+		}
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errInvalidToken
+		}
+	case "RS256":
+		key := a.rsaKey(header.Kid)
+		if key == nil {
+			return nil, errInvalidToken
+		}
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errInvalidToken
+		}
+	default:
+		return nil, errInvalidToken
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errExpiredToken
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errInvalidToken
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return nil, errInvalidToken
+	}
+	if a.audience != "" && !claimContains(claims["aud"], a.audience) {
+		return nil, errInvalidToken
+	}
+
+	principal := &Principal{Claims: claims}
+	principal.Subject, _ = claims["sub"].(string)
+	if scope, ok := claims["scope"].(string); ok {
+		principal.Scopes = strings.Fields(scope)
+	}
+	return principal, nil
+}
+
+// Get RSA key by id. The only key is used if the token has no key id.
+func (a *authConfig) rsaKey(kid string) *rsa.PublicKey {
+	if key, ok := a.rsaKeys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(a.rsaKeys) == 1 {
+		for _, key := range a.rsaKeys {
+			return key
+		}
+	}
+	return nil
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Check whether the claim is the value or the list containing the value.
+func claimContains(claim interface{}, value string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == value
+	case []interface{}:
+		for _, item := range v {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Parse RSA public keys of the JSON Web Key Set by their ids.
+func parseJwks(data []byte) (map[string]*rsa.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range jwks.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, errors.New(`jwks: invalid modulus of key "` + key.Kid + `"`)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, errors.New(`jwks: invalid exponent of key "` + key.Kid + `"`)
+		}
+		keys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+type AuthSuiteTester struct {
+	BaseSuite
+
+	mux    *web.Mux
+	rsaKey *rsa.PrivateKey
+}
+
+// Settings for suite
+func (suite *AuthSuiteTester) SetupSuite() {
+	var err error
+	// INIT RSA key
+	suite.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// AND test router which responds with the subject of the principal
+	router := func(c web.C, w http.ResponseWriter, r *http.Request) {
+		if principal := GetPrincipal(c); principal != nil {
+			w.Write([]byte(principal.Subject))
+		}
+	}
+	suite.mux = web.New()
+	suite.mux.Use(Auth)
+	suite.mux.Get("/", router)
+	suite.mux.Post("/", router)
+	suite.mux.Post(BatchGetUrl, router)
+}
+
+// Settings for each test
+func (suite *AuthSuiteTester) SetupTest() {
+	// INIT configured credentials
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(suite.rsaKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(suite.rsaKey.E)).Bytes()),
+		}},
+	})
+	keys, err := parseJwks(jwks)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	auth = &authConfig{
+		apiKeys: []string{"secret-key"},
+		secret:  []byte("jwt-secret"),
+		rsaKeys: keys,
+		issuer:  "issuer",
+	}
+	*AuthWriteScope = ""
+	*AuthPublicRead = true
+}
+
+// Restore settings after each test
+func (suite *AuthSuiteTester) TearDownTest() {
+	auth = &authConfig{}
+	*AuthWriteScope = ""
+}
+
+// Build signed token with the given algorithm and claims.
+func (suite *AuthSuiteTester) token(alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, []byte("jwt-secret"))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, suite.rsaKey, crypto.SHA256, digest[:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Send request with given method and headers.
+func (suite *AuthSuiteTester) request(method string, headers map[string]string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest(method, "/", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	return w
+}
+
+// Test public reading
+func (suite *AuthSuiteTester) TestPublicRead() {
+	// WHEN I send GET request without credentials
+	w := suite.request("GET", nil)
+	// THEN response status code should be 200
+	suite.Equal(http.StatusOK, w.Code)
+
+	// WHEN I send bulk lookup without credentials
+	r, err := http.NewRequest("POST", BatchGetUrl, nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w = httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	// THEN it should be public as reading
+	suite.Equal(http.StatusOK, w.Code)
+
+	// WHEN public reading is disabled
+	*AuthPublicRead = false
+	w = suite.request("GET", nil)
+	// THEN response status code should be 401
+	suite.Equal(http.StatusUnauthorized, w.Code)
+}
+
+// Test writing with API key
+func (suite *AuthSuiteTester) TestApiKey() {
+	// WHEN I send POST request without credentials
+	w := suite.request("POST", nil)
+	// THEN response status code should be 401
+	suite.Equal(http.StatusUnauthorized, w.Code)
+	suite.Equal(`Bearer realm="avatars"`, w.Header().Get("WWW-Authenticate"))
+
+	// WHEN I send POST request with invalid API key
+	w = suite.request("POST", map[string]string{"api_key": "wrong"})
+	// THEN response status code should be 401
+	suite.Equal(http.StatusUnauthorized, w.Code)
+
+	// WHEN I send POST request with valid API key
+	w = suite.request("POST", map[string]string{"api_key": "secret-key"})
+	// THEN response status code should be 200
+	suite.Equal(http.StatusOK, w.Code)
+}
+
+// Test writing with verified client certificate
+func (suite *AuthSuiteTester) TestClientCert() {
+	// GIVEN request with verified client certificate
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "uploader"}}
+	r, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	// WHEN I send it while client certificates are not configured
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	// THEN response status code should be 401
+	suite.Equal(http.StatusUnauthorized, w.Code)
+
+	// WHEN client certificates are configured
+	auth.clientCerts = true
+	w = httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	// THEN the client should be authenticated by the certificate
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal("cert:uploader", w.Body.String())
+}
+
+// Test service rights of client certificates
+func (suite *AuthSuiteTester) TestServiceCert() {
+	// GIVEN client certificates of the listed service
+	auth.clientCerts = true
+	auth.serviceCerts = []string{"uploader", "resizer.example.com"}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "uploader"}}
+	san := &x509.Certificate{Subject: pkix.Name{CommonName: "resizer"}, DNSNames: []string{"resizer.example.com"}}
+	for _, cert := range []*x509.Certificate{cert, san} {
+		r, _ := http.NewRequest("POST", "/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		principal, err := auth.authenticate(r)
+		// THEN the client should be authenticated as a service
+		suite.Nil(err)
+		suite.True(principal.IsService(), cert.Subject.CommonName)
+	}
+
+	// WHEN the certificate is signed by the CA but not listed
+	r, _ := http.NewRequest("POST", "/", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "other"}}}}}
+	principal, err := auth.authenticate(r)
+	// THEN the client should be authenticated as a user
+	suite.Nil(err)
+	suite.Equal("cert:other", principal.Subject)
+	suite.False(principal.IsService())
+}
+
+// Test writing with JWT
+func (suite *AuthSuiteTester) TestToken() {
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	for _, alg := range []string{"HS256", "RS256"} {
+		// WHEN I send POST request with valid token
+		token := suite.token(alg, map[string]interface{}{"sub": "user", "iss": "issuer", "exp": exp})
+		w := suite.request("POST", map[string]string{"Authorization": "Bearer " + token})
+		// THEN response status code should be 200
+		suite.Equal(http.StatusOK, w.Code, alg)
+		// AND principal should be set
+		suite.Equal("user", w.Body.String(), alg)
+	}
+}
+
+// Test invalid JWT
+func (suite *AuthSuiteTester) TestInvalidToken() {
+	past := float64(time.Now().Add(-time.Hour).Unix())
+	cases := map[string]string{
+		"expired":      suite.token("HS256", map[string]interface{}{"iss": "issuer", "exp": past}),
+		"wrong issuer": suite.token("RS256", map[string]interface{}{"iss": "other"}),
+		"unsigned":     suite.token("none", map[string]interface{}{"iss": "issuer"}),
+		"malformed":    "abc.def",
+		"tampered":     suite.token("HS256", map[string]interface{}{"iss": "issuer"}) + "x",
+	}
+	for name, token := range cases {
+		w := suite.request("POST", map[string]string{"Authorization": "Bearer " + token})
+		suite.Equal(http.StatusUnauthorized, w.Code, name)
+	}
+}
+
+// Test writing without required scope
+func (suite *AuthSuiteTester) TestScope() {
+	// GIVEN required write scope
+	*AuthWriteScope = "avatars:write"
+
+	// WHEN I send POST request with token without the scope
+	token := suite.token("HS256", map[string]interface{}{"iss": "issuer", "scope": "avatars:read"})
+	w := suite.request("POST", map[string]string{"Authorization": "Bearer " + token})
+	// THEN response status code should be 403
+	suite.Equal(http.StatusForbidden, w.Code)
+
+	// WHEN I send POST request with token with the scope
+	token = suite.token("HS256", map[string]interface{}{"iss": "issuer", "scope": "avatars:read avatars:write"})
+	w = suite.request("POST", map[string]string{"Authorization": "Bearer " + token})
+	// THEN response status code should be 200
+	suite.Equal(http.StatusOK, w.Code, w.Body.String())
+}
+
+// Test loading settings without credentials
+func (suite *AuthSuiteTester) TestNoCredentials() {
+	defer func(config *authConfig, adminScope string) {
+		auth = config
+		WritePolicy.(*OwnerPolicy).AdminScope = adminScope
+	}(auth, WritePolicy.(*OwnerPolicy).AdminScope)
+
+	// WHEN I load settings without credentials
+	err := initAuth()
+	// THEN it should fail
+	suite.Equal(errNoAuthConfig, err)
+
+	// WHEN I disable authentication explicitly
+	*AuthDisabled = true
+	defer func() { *AuthDisabled = false }()
+	err = initAuth()
+	// THEN settings should be loaded without credentials
+	suite.Nil(err)
+	suite.False(auth.enabled())
+}
+
+// TestRunAuthSuite will be run by the 'go test' command
+func TestRunAuthSuite(t *testing.T) {
+	Run(t, new(AuthSuiteTester))
+}
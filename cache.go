@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/drone/config"
+)
+
+// Query parameter with the version of the image.
+const VersionParam = "v"
+
+// Versioned URL always points to the same content.
+const ImmutableCacheControl = "public, max-age=31536000, immutable"
+
+var (
+	CacheMaxAge = config.Int("cache-max-age", 3600)
+)
+
+// Set headers which forbid caching of the response.
+func setNoCacheHeaders(h http.Header) {
+	h.Del("ETag")
+	h.Del("Cache-Control")
+	h.Add("Cache-Control", "no-cache")
+	h.Add("Cache-Control", "no-store")
+	h.Add("Cache-Control", "max-age=0")
+	h.Add("Cache-Control", "must-revalidate")
+	h.Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	h.Set("Expires", "Thu, 01 Jan 1970 00:00:00 GMT")
+}
+
+// Get "Cache-Control" value of stored images.
+func imageCacheControl() string {
+	return fmt.Sprintf("public, max-age=%d", *CacheMaxAge)
+}
+
+// Get strong ETag of the image variant: the stored file hash alone for the
+// file as is, or together with the query which transforms it.
+func variantETag(hash string, query url.Values) string {
+	if len(query) == 0 {
+		return `"` + hash + `"`
+	}
+	// Encode sorts values by key, so the same variant has the same tag
+	return fmt.Sprintf(`"%x"`, md5.Sum([]byte(hash+"?"+query.Encode())))
+}
+
+// Set caching headers of the image response and check conditional headers
+// of the request. If the client copy is still valid "304 Not Modified" is
+// written and true is returned.
+func cacheResponse(w http.ResponseWriter, r *http.Request, cacheControl string, etag string, modified time.Time) bool {
+	h := w.Header()
+	h.Del("Expires")
+	h.Set("Cache-Control", cacheControl)
+	h.Set("ETag", etag)
+	if modified.IsZero() {
+		h.Del("Last-Modified")
+	} else {
+		h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if !isNotModified(r, etag, modified) {
+		observeCache(false)
+		return false
+	}
+	observeCache(true)
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Check "If-None-Match" and "If-Modified-Since" request headers.
+// "If-Modified-Since" is ignored when "If-None-Match" is set (RFC 7232).
+func isNotModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// Check whether the list of entity tags matches the tag using the weak
+// comparison.
+func etagMatch(list string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "*" || strings.TrimPrefix(item, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the version parameter from the request query and get its value.
+func popVersion(r *http.Request) string {
+	query := r.URL.Query()
+	version := query.Get(VersionParam)
+	if _, ok := query[VersionParam]; ok {
+		query.Del(VersionParam)
+		r.URL.RawQuery = query.Encode()
+	}
+	return version
+}
+
+// Get "Cache-Control" value of the stored image of the current version.
+// Requests of a stale version are redirected to the current one and false
+// is returned.
+func versionCacheControl(w http.ResponseWriter, r *http.Request, requested string, current string) (string, bool) {
+	if requested == "" {
+		return imageCacheControl(), true
+	}
+	if requested == current {
+		return ImmutableCacheControl, true
+	}
+	query := r.URL.Query()
+	query.Set(VersionParam, current)
+	location := *r.URL
+	location.RawQuery = query.Encode()
+	http.Redirect(w, r, location.String(), http.StatusFound)
+	return "", false
+}
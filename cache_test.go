@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type CacheSuiteTester struct {
+	BaseSuite
+
+	etag     string
+	modified time.Time
+}
+
+// Settings for suite
+func (suite *CacheSuiteTester) SetupSuite() {
+	// INIT entity tag and modification time of the image
+	suite.etag = variantETag(RandomMD5(), nil)
+	suite.modified = time.Date(2015, 6, 1, 12, 0, 0, 500, time.UTC)
+}
+
+// Send request with given headers through cacheResponse.
+func (suite *CacheSuiteTester) request(headers map[string]string) (*httptest.ResponseRecorder, bool) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	return w, cacheResponse(w, r, imageCacheControl(), suite.etag, suite.modified)
+}
+
+// Test caching headers of the response
+func (suite *CacheSuiteTester) TestHeaders() {
+	// WHEN I send request without conditional headers
+	w, notModified := suite.request(nil)
+	// THEN response should not be "not modified"
+	suite.False(notModified)
+	// AND caching headers should be set
+	suite.Equal(suite.etag, w.Header().Get("ETag"))
+	suite.Equal("Mon, 01 Jun 2015 12:00:00 GMT", w.Header().Get("Last-Modified"))
+	suite.Equal(imageCacheControl(), w.Header().Get("Cache-Control"))
+}
+
+// Test "If-None-Match" header
+func (suite *CacheSuiteTester) TestIfNoneMatch() {
+	cases := map[string]bool{
+		suite.etag:               true,
+		"W/" + suite.etag:        true,
+		`"other", ` + suite.etag: true,
+		"*":                      true,
+		`"other"`:                false,
+	}
+	for value, expected := range cases {
+		// WHEN I send request with "If-None-Match" header
+		w, notModified := suite.request(map[string]string{"If-None-Match": value})
+		// THEN response should be "not modified" if tag matches
+		suite.Equal(expected, notModified, value)
+		if expected {
+			suite.Equal(http.StatusNotModified, w.Code, value)
+		}
+	}
+}
+
+// Test "If-Modified-Since" header
+func (suite *CacheSuiteTester) TestIfModifiedSince() {
+	cases := map[string]bool{
+		"Mon, 01 Jun 2015 12:00:00 GMT": true,
+		"Tue, 02 Jun 2015 12:00:00 GMT": true,
+		"Sun, 31 May 2015 12:00:00 GMT": false,
+		"invalid date":                  false,
+	}
+	for value, expected := range cases {
+		_, notModified := suite.request(map[string]string{"If-Modified-Since": value})
+		suite.Equal(expected, notModified, value)
+	}
+
+	// WHEN I send both headers with mismatching tag
+	_, notModified := suite.request(map[string]string{
+		"If-None-Match":     `"other"`,
+		"If-Modified-Since": "Tue, 02 Jun 2015 12:00:00 GMT",
+	})
+	// THEN "If-Modified-Since" should be ignored
+	suite.False(notModified)
+}
+
+// Test tags of the image variants
+func (suite *CacheSuiteTester) TestVariantETag() {
+	// GIVEN the same query with different order of parameters
+	first, _ := url.ParseQuery("w=10&h=20")
+	second, _ := url.ParseQuery("h=20&w=10")
+	// THEN variant tags should be equal
+	suite.Equal(variantETag("hash", first), variantETag("hash", second))
+	// AND differ from the tag of the file
+	suite.NotEqual(variantETag("hash", nil), variantETag("hash", first))
+}
+
+// Test versioned requests
+func (suite *CacheSuiteTester) TestVersion() {
+	// GIVEN request of the image version with resize parameters
+	r, err := http.NewRequest("GET", "/api/v1/file/"+RandomMD5()+"?s=10&v=old", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+
+	// WHEN I get version from the request
+	version := popVersion(r)
+	// THEN version should be returned
+	suite.Equal("old", version)
+	// AND removed from the query
+	suite.Equal("s=10", r.URL.RawQuery)
+
+	// WHEN I request the current version
+	w := httptest.NewRecorder()
+	cacheControl, ok := versionCacheControl(w, r, "new", "new")
+	// THEN response should be cached forever
+	suite.True(ok)
+	suite.Equal(ImmutableCacheControl, cacheControl)
+
+	// WHEN I request unversioned image
+	cacheControl, ok = versionCacheControl(w, r, "", "new")
+	// THEN response should be cached for configured time
+	suite.True(ok)
+	suite.Equal(imageCacheControl(), cacheControl)
+
+	// WHEN I request stale version
+	_, ok = versionCacheControl(w, r, version, "new")
+	// THEN request should be redirected to the current version
+	suite.False(ok)
+	suite.Equal(http.StatusFound, w.Code)
+	suite.Equal(r.URL.Path+"?s=10&v=new", w.Header().Get("Location"))
+}
+
+// Test URLs of the avatar
+func (suite *CacheSuiteTester) TestAvatarUrls() {
+	// GIVEN avatar with different original and thumbnail files
+	avatar := &Avatar{Id: RandomMD5(), Origin: bson.NewObjectId(), Thumb: bson.NewObjectId()}
+
+	// WHEN I set URLs
+	avatar.setUrls()
+	// THEN URLs should contain file versions
+	suite.Equal(ApiUrl+"file/"+avatar.Id+"/raw?v="+avatar.Origin.Hex(), avatar.UrlOrigin)
+	suite.Equal(ApiUrl+"file/"+avatar.Id+"?v="+avatar.Thumb.Hex(), avatar.UrlThumb)
+}
+
+// TestRunCacheSuite will be run by the 'go test' command
+func TestRunCacheSuite(t *testing.T) {
+	Run(t, new(CacheSuiteTester))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/drone/config"
+	"github.com/zenazn/goji/web"
+)
+
+var (
+	CorsReadOrigins      = config.String("cors-read-origins", "*")
+	CorsReadCredentials  = config.Bool("cors-read-credentials", false)
+	CorsWriteOrigins     = config.String("cors-write-origins", "*")
+	CorsWriteCredentials = config.Bool("cors-write-credentials", false)
+	CorsAllowHeaders     = config.String("cors-allow-headers", "Content-Type, api_key, Authorization, If-None-Match, If-Modified-Since, Range, Content-Disposition, X-Mask, X-Request-ID, traceparent, tracestate")
+	CorsExposeHeaders    = config.String("cors-expose-headers", "ETag, Last-Modified, Content-Length, Content-Range, X-Request-ID")
+	CorsMaxAge           = config.Int("cors-max-age", 600)
+)
+
+// CorsPolicy describes which origins may access the methods.
+type CorsPolicy struct {
+	// Exact origins or patterns like "https://*.example.com", "*" allows any origin.
+	Origins     []string
+	Methods     []string
+	Credentials bool
+}
+
+// Check whether the origin is allowed by the policy.
+func (p *CorsPolicy) allowOrigin(origin string) bool {
+	for _, pattern := range p.Origins {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+		if match, err := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); err == nil && match {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	corsReadPolicy = &CorsPolicy{
+		Origins: []string{"*"},
+		Methods: []string{"GET", "HEAD"},
+	}
+	corsWritePolicy = &CorsPolicy{
+		Origins: []string{"*"},
+		Methods: []string{"POST", "PUT", "DELETE", "PATCH"},
+	}
+)
+
+// Load CORS policies. Should be called after the configuration is parsed.
+// Any origin can't be allowed with credentials: every site could act on
+// behalf of the user.
+func initCors() error {
+	corsReadPolicy = &CorsPolicy{
+		Origins:     splitList(*CorsReadOrigins),
+		Methods:     corsReadPolicy.Methods,
+		Credentials: *CorsReadCredentials,
+	}
+	corsWritePolicy = &CorsPolicy{
+		Origins:     splitList(*CorsWriteOrigins),
+		Methods:     corsWritePolicy.Methods,
+		Credentials: *CorsWriteCredentials,
+	}
+	for _, policy := range []*CorsPolicy{corsReadPolicy, corsWritePolicy} {
+		if policy.Credentials && contains(policy.Origins, "*") {
+			return errors.New(`origin "*" can't be allowed with credentials`)
+		}
+	}
+	return nil
+}
+
+// Split comma separated list and trim spaces of the items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Get the policy of the request. The bulk lookup is sent by POST but is a
+// read, like everywhere else.
+func corsPolicy(r *http.Request) *CorsPolicy {
+	if isReadRequest(r) {
+		return corsReadPolicy
+	}
+	return corsWritePolicy
+}
+
+// Cors sets CORS headers of the actual and preflight requests by the policy
+// of the requested method and path: reading or writing. Requests of
+// origins which are not allowed get no CORS headers. Responses vary by
+// origin even for requests without it, so shared caches don't serve them
+// cross-origin.
+func Cors(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// the policy of preflight request is the one of the actual request
+		actual := *r
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			actual.Method = r.Header.Get("Access-Control-Request-Method")
+		}
+
+		policy := corsPolicy(&actual)
+		if !policy.allowOrigin(origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if contains(policy.Origins, "*") {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if policy.Credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			methods := policy.Methods
+			if !contains(methods, actual.Method) {
+				methods = append(methods[:len(methods):len(methods)], actual.Method)
+			}
+			header.Set("Access-Control-Allow-Methods", strings.Join(methods, ",")+",OPTIONS")
+			header.Set("Access-Control-Allow-Headers", *CorsAllowHeaders)
+			header.Set("Access-Control-Max-Age", strconv.Itoa(*CorsMaxAge))
+		} else if *CorsExposeHeaders != "" {
+			header.Set("Access-Control-Expose-Headers", *CorsExposeHeaders)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
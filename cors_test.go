@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+type CorsSuiteTester struct {
+	BaseSuite
+
+	mux *web.Mux
+}
+
+// Settings for suite
+func (suite *CorsSuiteTester) SetupSuite() {
+	// INIT router with "Cors" and "Options" middlewares
+	router := func(c web.C, w http.ResponseWriter, r *http.Request) {}
+	suite.mux = web.New()
+	suite.mux.Use(Cors)
+	suite.mux.Use(Options)
+	suite.mux.Get("/", router)
+	suite.mux.Post("/", router)
+	suite.mux.Post(BatchGetUrl, router)
+}
+
+// Settings for each test
+func (suite *CorsSuiteTester) SetupTest() {
+	// INIT public reading and credentialed writing from subdomains
+	corsReadPolicy = &CorsPolicy{Origins: []string{"*"}, Methods: []string{"GET", "HEAD"}}
+	corsWritePolicy = &CorsPolicy{
+		Origins:     []string{"https://app.example.com", "https://*.example.org"},
+		Methods:     []string{"POST", "PUT", "DELETE", "PATCH"},
+		Credentials: true,
+	}
+}
+
+// Send request from the origin.
+func (suite *CorsSuiteTester) request(method string, origin string, headers map[string]string) http.Header {
+	return suite.requestUrl(method, "/", origin, headers)
+}
+
+// Send request of the URL from the origin.
+func (suite *CorsSuiteTester) requestUrl(method string, url string, origin string, headers map[string]string) http.Header {
+	r, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.Header.Set("Origin", origin)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	suite.Equal(http.StatusOK, w.Code)
+	return w.Header()
+}
+
+// Test reading from any origin
+func (suite *CorsSuiteTester) TestRead() {
+	// WHEN I send GET request from any origin
+	header := suite.request("GET", "https://any.com", nil)
+	// THEN any origin should be allowed
+	suite.Equal("*", header.Get("Access-Control-Allow-Origin"))
+	// AND tags should be exposed
+	suite.Contains(header.Get("Access-Control-Expose-Headers"), "ETag")
+	suite.Equal("", header.Get("Access-Control-Allow-Credentials"))
+}
+
+// Test writing from allowed origins
+func (suite *CorsSuiteTester) TestWrite() {
+	for _, origin := range []string{"https://app.example.com", "https://admin.example.org"} {
+		// WHEN I send POST request from allowed origin
+		header := suite.request("POST", origin, nil)
+		// THEN the origin should be allowed with credentials
+		suite.Equal(origin, header.Get("Access-Control-Allow-Origin"), origin)
+		suite.Equal("true", header.Get("Access-Control-Allow-Credentials"), origin)
+	}
+
+	for _, origin := range []string{"https://any.com", "https://example.org.evil.com"} {
+		// WHEN I send POST request from another origin
+		header := suite.request("POST", origin, nil)
+		// THEN no origin should be allowed
+		suite.Equal("", header.Get("Access-Control-Allow-Origin"), origin)
+	}
+}
+
+// Test preflight request
+func (suite *CorsSuiteTester) TestPreflight() {
+	// WHEN I send preflight request of writing
+	header := suite.request("OPTIONS", "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method": "DELETE",
+	})
+	// THEN writing policy should be used
+	suite.Equal("https://app.example.com", header.Get("Access-Control-Allow-Origin"))
+	suite.Equal("POST,PUT,DELETE,PATCH,OPTIONS", header.Get("Access-Control-Allow-Methods"))
+	suite.Contains(header.Get("Access-Control-Allow-Headers"), "Authorization")
+	suite.NotEqual("", header.Get("Access-Control-Max-Age"))
+
+	// WHEN I send preflight request of writing from another origin
+	header = suite.request("OPTIONS", "https://any.com", map[string]string{
+		"Access-Control-Request-Method": "DELETE",
+	})
+	// THEN no origin should be allowed
+	suite.Equal("", header.Get("Access-Control-Allow-Origin"))
+}
+
+// Test preflight request of the bulk lookup
+func (suite *CorsSuiteTester) TestBatchGetPreflight() {
+	// WHEN I send preflight request of the bulk lookup from any origin
+	header := suite.requestUrl("OPTIONS", BatchGetUrl, "https://any.com", map[string]string{
+		"Access-Control-Request-Method": "POST",
+	})
+	// THEN reading policy should be used
+	suite.Equal("*", header.Get("Access-Control-Allow-Origin"))
+	suite.Equal("GET,HEAD,POST,OPTIONS", header.Get("Access-Control-Allow-Methods"))
+	// AND reading policy should not be changed
+	suite.Equal([]string{"GET", "HEAD"}, corsReadPolicy.Methods)
+
+	// WHEN I send the bulk lookup from any origin
+	header = suite.requestUrl("POST", BatchGetUrl, "https://any.com", nil)
+	// THEN any origin should be allowed
+	suite.Equal("*", header.Get("Access-Control-Allow-Origin"))
+}
+
+// Test varying responses by origin
+func (suite *CorsSuiteTester) TestVary() {
+	// WHEN I send GET request without origin
+	header := suite.request("GET", "", nil)
+	// THEN response should vary by origin
+	suite.Equal("Origin", header.Get("Vary"))
+	suite.Equal("", header.Get("Access-Control-Allow-Origin"))
+}
+
+// Test loading policies from the configuration
+func (suite *CorsSuiteTester) TestInitCors() {
+	defer func() { *CorsWriteCredentials = false }()
+
+	// WHEN I allow credentials for explicit origins
+	*CorsWriteOrigins = "https://app.example.com"
+	*CorsWriteCredentials = true
+	// THEN policies should be loaded
+	suite.Nil(initCors())
+
+	// WHEN I allow credentials for any origin
+	*CorsWriteOrigins = "*"
+	// THEN loading should fail
+	suite.NotNil(initCors())
+}
+
+// TestRunCorsSuite will be run by the 'go test' command
+func TestRunCorsSuite(t *testing.T) {
+	Run(t, new(CorsSuiteTester))
+}
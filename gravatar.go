@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/zenazn/goji/web"
+	"gopkg.in/mgo.v2"
+)
+
+const GravatarDefaultSize = 80
+
+var (
+	mysteryPersonBackground = color.NRGBA{0xc5, 0xc5, 0xc5, 0xff}
+	mysteryPersonForeground = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// Serve avatar the way Gravatar does, so Gravatar clients can be pointed at
+// the service. Supported parameters are "s" or "size", "d" or "default",
+// "f" or "forcedefault" and "r" or "rating".
+func GetGravatar(c web.C, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := c.URLParams["id"]
+	id = strings.TrimSuffix(id, filepath.Ext(id))
+
+	size := gravatarSize(firstParam(query, "s", "size"))
+	def := firstParam(query, "d", "default")
+	force := firstParam(query, "f", "forcedefault")
+	// NOTE: "r" rating is ignored, avatars are not rated so all of them are served.
+
+	if force != "y" {
+		var buf *bytes.Buffer
+		err := WithThumbnailImage(r.Context(), id, func(file *mgo.GridFile) error {
+			if cacheResponse(w, r, imageCacheControl(), variantETag(file.MD5(), query), file.UploadDate()) {
+				return nil
+			}
+			buf = bytes.NewBuffer(nil)
+			_, err := io.Copy(buf, newContextReader(r.Context(), file))
+			return err
+		})
+		if err == nil {
+			if buf != nil && limitResize(c, w, r) {
+				gravatarToResponse(w, r, buf, size)
+			}
+			return
+		}
+		if err.Error() != "not found" {
+			JsonResponseError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if cacheResponse(w, r, "no-cache", variantETag("default:"+id, query), time.Time{}) {
+		return
+	}
+
+	var img image.Image
+	switch def {
+	case "404":
+		JsonResponseMsg(w, http.StatusNotFound, `not found`)
+		return
+	case "identicon":
+		img = renderIdenticon(id, IdenticonGeometric, size)
+	case "retro":
+		img = renderIdenticon(id, IdenticonGrid, size)
+	case "initials":
+		var err error
+		img, err = renderInitials(id, firstParam(query, "name"), size)
+		if err != nil {
+			JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	case "blank":
+		img = image.NewNRGBA(image.Rect(0, 0, size, size))
+	default:
+		if u, err := url.Parse(def); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			http.Redirect(w, r, u.String(), http.StatusFound)
+			return
+		}
+		img = renderMysteryPerson(size)
+	}
+
+	encodeToResponse(&contextResponseWriter{w, r.Context()}, img, "image/png")
+	return
+}
+
+// Get the first non-empty value of the query parameters.
+func firstParam(query url.Values, names ...string) string {
+	for _, name := range names {
+		if value := query.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Parse the size the way Gravatar does: invalid values fall back to the
+// default size, values out of range are clamped.
+func gravatarSize(value string) int {
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return GravatarDefaultSize
+	}
+	if size < 1 {
+		return 1
+	}
+	if size > MaxImageSize {
+		return MaxImageSize
+	}
+	return size
+}
+
+// Write the stored avatar cropped and resized to a square of the given size.
+func gravatarToResponse(w http.ResponseWriter, r *http.Request, buf interface{}, size int) {
+	file := buf.(*bytes.Buffer)
+	fileBytesArray, filetype, err := getFileType(file)
+	if err != nil {
+		JsonResponseMsg(w, http.StatusInternalServerError, `can't read the file`)
+		return
+	}
+
+	img, _, err := image.Decode(newContextReader(r.Context(), bytes.NewReader(fileBytesArray)))
+	if err != nil {
+		JsonResponseError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if img, err = cropImage(img, smartCrop(img, 1, 1)); err != nil {
+		JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	img = resize.Resize(uint(size), uint(size), img, resize.Lanczos3)
+	if requestDone(w, r) {
+		return
+	}
+
+	if ok := contains(supportedMediaTypes, filetype); !ok {
+		JsonResponseMsg(w, http.StatusUnsupportedMediaType, `UNSUPPORTED_MEDIA_TYPE`)
+		return
+	}
+	encodeToResponse(&contextResponseWriter{w, r.Context()}, img, filetype)
+	return
+}
+
+// Render "mystery person" silhouette: head and shoulders on gray background.
+func renderMysteryPerson(size int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	s := float64(size)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			fx, fy := (float64(x)+0.5)/s, (float64(y)+0.5)/s
+			head := (fx-0.5)*(fx-0.5)+(fy-0.38)*(fy-0.38) <= 0.19*0.19
+			body := (fx-0.5)*(fx-0.5)/(0.38*0.38)+(fy-1.05)*(fy-1.05)/(0.36*0.36) <= 1
+			if head || body {
+				img.Set(x, y, mysteryPersonForeground)
+			} else {
+				img.Set(x, y, mysteryPersonBackground)
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+type GravatarSuiteTester struct {
+	BaseSuite
+
+	mux *web.Mux
+}
+
+// Settings for suite
+func (suite *GravatarSuiteTester) SetupSuite() {
+	// INIT test router with Gravatar handler
+	suite.mux = web.New()
+	suite.mux.Get("/avatar/:id", GetGravatar)
+}
+
+// Send GET request and get the response.
+func (suite *GravatarSuiteTester) get(url string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	return w
+}
+
+// Test parsing size parameter
+func (suite *GravatarSuiteTester) TestSize() {
+	cases := map[string]int{
+		"":      GravatarDefaultSize,
+		"abc":   GravatarDefaultSize,
+		"0":     1,
+		"100":   100,
+		"99999": MaxImageSize,
+	}
+	for value, expected := range cases {
+		suite.Equal(expected, gravatarSize(value), value)
+	}
+}
+
+// Test forced default images
+func (suite *GravatarSuiteTester) TestForceDefault() {
+	for _, def := range []string{"mp", "identicon", "retro", "blank", "initials&name=Jo"} {
+		// WHEN I request forced default image with the "size" parameter
+		w := suite.get("/avatar/" + RandomMD5() + ".png?size=40&forcedefault=y&d=" + def)
+		// THEN response status code should be 200
+		suite.Equal(http.StatusOK, w.Code, def)
+		// AND response should be PNG image of requested size
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			suite.T().Error(err.Error())
+		}
+		suite.Equal(image.Rect(0, 0, 40, 40), img.Bounds(), def)
+	}
+}
+
+// Test "404" default
+func (suite *GravatarSuiteTester) TestNotFound() {
+	// WHEN I request forced default image with "d=404"
+	w := suite.get("/avatar/" + RandomMD5() + "?f=y&d=404")
+	// THEN response status code should be 404
+	suite.Equal(http.StatusNotFound, w.Code)
+}
+
+// Test URL default
+func (suite *GravatarSuiteTester) TestRedirect() {
+	// WHEN I request forced default image with encoded URL
+	w := suite.get("/avatar/" + RandomMD5() + "?f=y&d=https%3A%2F%2Fexample.com%2Fdefault.png")
+	// THEN response should redirect to the URL
+	suite.Equal(http.StatusFound, w.Code)
+	suite.Equal("https://example.com/default.png", w.Header().Get("Location"))
+}
+
+// TestRunGravatarSuite will be run by the 'go test' command
+func TestRunGravatarSuite(t *testing.T) {
+	Run(t, new(GravatarSuiteTester))
+}
@@ -2,19 +2,31 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"image"
+	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nfnt/resize"
 	"github.com/zenazn/goji/web"
 	"golang.org/x/image/bmp"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var supportedMediaTypes = []string{"image/jpeg", "image/jpg", "image/bmp", "image/png", "image/gif"}
@@ -23,6 +35,20 @@ type Mask struct {
 	Mask []int `json:"mask"`
 }
 
+// Ids of the avatars to look up in bulk.
+type BatchGet struct {
+	Ids []string `json:"ids"`
+}
+
+const (
+	// Max number of ids in one bulk lookup.
+	maxBatchGetIds = 100
+	// Size limit of the bulk lookup body.
+	maxBatchGetBody = 64 * 1024
+)
+
+var md5Pattern = regexp.MustCompile("^[a-fA-F0-9]{32}$")
+
 func UploadFile(c web.C, w http.ResponseWriter, r *http.Request) {
 	isNew := true
 	uploadFile(c, w, r, isNew)
@@ -50,10 +76,18 @@ func ChangeMask(c web.C, w http.ResponseWriter, r *http.Request) {
 		JsonResponseMsg(w, http.StatusBadRequest, `field "config" should contain 4 integer elements`)
 		return
 	}
+	if err = checkMaskRect(mask.Mask); err != nil {
+		JsonResponseMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	avatarInterface, err = ChangeThumbnail(c.URLParams["id"], mask.Mask)
+	avatarInterface, err = ChangeThumbnail(r.Context(), c.URLParams["id"], mask.Mask)
 	if err != nil {
-		JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
+		status := http.StatusInternalServerError
+		if err == errMaskRect || err == errMaskOutOfBounds {
+			status = http.StatusBadRequest
+		}
+		JsonResponseError(w, status, err)
 		return
 	}
 	avatar = avatarInterface.(*Avatar)
@@ -62,10 +96,24 @@ func ChangeMask(c web.C, w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+var (
+	errMaskRect        = errors.New(`mask should be [x0, y0, x1, y1] with 0 <= x0 < x1 and 0 <= y0 < y1`)
+	errMaskOutOfBounds = errors.New(`mask should lie inside the image`)
+)
+
+// Check that the mask of 4 elements is a non-empty rectangle. Its bounds
+// are checked against the image when it is read.
+func checkMaskRect(mask []int) error {
+	if mask[0] < 0 || mask[1] < 0 || mask[0] >= mask[2] || mask[1] >= mask[3] {
+		return errMaskRect
+	}
+	return nil
+}
+
 func DeleteFile(c web.C, w http.ResponseWriter, r *http.Request) {
-	err := DeleteImage(c.URLParams["id"])
+	err := DeleteImage(r.Context(), c.URLParams["id"])
 	if err != nil {
-		JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
+		JsonResponseError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -73,8 +121,108 @@ func DeleteFile(c web.C, w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// Respond with the avatar metadata: dimensions, sizes and hashes of the
+// images, the mask, timestamps and the original file name.
+func GetFileMeta(c web.C, w http.ResponseWriter, r *http.Request) {
+	avatar, err := GetAvatarMetaById(r.Context(), c.URLParams["id"])
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "not found" {
+			status = http.StatusNotFound
+		}
+		JsonResponseError(w, status, err)
+		return
+	}
+	JsonResponseFromStruct(w, http.StatusOK, avatar)
+	return
+}
+
+// Look up avatars by ids with one query. Respond with the avatars which exist
+// and the list of missing ids. The lookup is a read, it is sent by POST only
+// to fit the ids into the body.
+func BatchGetFiles(w http.ResponseWriter, r *http.Request) {
+	var batch BatchGet
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchGetBody)).Decode(&batch); err != nil {
+		JsonResponseMsg(w, http.StatusBadRequest, `body should be json object with "ids" field`)
+		return
+	}
+	if len(batch.Ids) == 0 || len(batch.Ids) > maxBatchGetIds {
+		JsonResponseMsg(w, http.StatusBadRequest, `field "ids" should contain from 1 to `+strconv.Itoa(maxBatchGetIds)+` ids`)
+		return
+	}
+	ids := make([]string, 0, len(batch.Ids))
+	requested := make(map[string]bool, len(batch.Ids))
+	for _, id := range batch.Ids {
+		if !md5Pattern.MatchString(id) {
+			JsonResponseMsg(w, http.StatusBadRequest, `"Id" must be MD5 hash string`)
+			return
+		}
+		if !requested[id] {
+			requested[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	avatars, err := GetAvatarsByIds(r.Context(), ids)
+	if err != nil {
+		JsonResponseError(w, http.StatusInternalServerError, err)
+		return
+	}
+	found := make(map[string]*Avatar, len(avatars))
+	for _, avatar := range avatars {
+		found[avatar.Id] = avatar
+	}
+	result := BatchGetResult{Avatars: []*Avatar{}, Missing: []string{}}
+	for _, id := range ids {
+		if avatar, ok := found[id]; ok {
+			result.Avatars = append(result.Avatars, avatar)
+		} else {
+			result.Missing = append(result.Missing, id)
+		}
+	}
+	JsonResponse(w, http.StatusOK, result)
+	return
+}
+
+// Serve the original file as is. The file is streamed from GridFS with
+// support of "Range", "If-Range" and HEAD requests.
 func GetOriginalFile(c web.C, w http.ResponseWriter, r *http.Request) {
-	imageToResponse(GetOriginalImageById, c.URLParams["id"], w)
+	version := popVersion(r)
+	err := WithOriginalImage(r.Context(), c.URLParams["id"], func(file *mgo.GridFile) error {
+		cacheControl, ok := versionCacheControl(w, r, version, file.Id().(bson.ObjectId).Hex())
+		if !ok {
+			return nil
+		}
+		if cacheResponse(w, r, cacheControl, variantETag(file.MD5(), nil), file.UploadDate()) {
+			return nil
+		}
+
+		// sniff content type from the head of the file and rewind it
+		head := make([]byte, 512)
+		n, err := io.ReadFull(file, head)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(head[:n]))
+
+		content := struct {
+			io.Reader
+			io.Seeker
+		}{newContextReader(r.Context(), file), file}
+		http.ServeContent(w, r, file.Name(), file.UploadDate(), content)
+		return nil
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "not found" {
+			status = http.StatusNotFound
+		}
+		JsonResponseError(w, status, err)
+		return
+	}
 	return
 }
 
@@ -85,64 +233,132 @@ func GetResizedFile(c web.C, w http.ResponseWriter, r *http.Request) {
 		resizedImage        image.Image
 	)
 
-	if len(r.URL.Query()) == 0 {
-		imageToResponse(GetThumbnailImageById, c.URLParams["id"], w)
+	// ETag and content are read from the same file, so a concurrent update
+	// can't pair the tag of one version with the content of another
+	version := popVersion(r)
+	var buf *bytes.Buffer
+	err = WithThumbnailImage(r.Context(), c.URLParams["id"], func(file *mgo.GridFile) error {
+		dropDefaultParams(r)
+		cacheControl, ok := versionCacheControl(w, r, version, file.Id().(bson.ObjectId).Hex())
+		if !ok {
+			return nil
+		}
+		if cacheResponse(w, r, cacheControl, variantETag(file.MD5(), r.URL.Query()), file.UploadDate()) {
+			return nil
+		}
+		buf = bytes.NewBuffer(nil)
+		_, err := io.Copy(buf, newContextReader(r.Context(), file))
+		return err
+	})
+	if err != nil {
+		if err.Error() == "not found" {
+			GetDefaultFile(c, w, r)
+			return
+		}
+		JsonResponseError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if buf == nil {
 		return
 	}
 
-	buf, err := GetThumbnailImageById(c.URLParams["id"])
-	if err != nil {
-		JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
+	if len(r.URL.Query()) == 0 {
+		bufferToResponse(buf, w)
 		return
 	}
 
 	_, hOk := r.URL.Query()["h"]
 	_, wOk := r.URL.Query()["w"]
 	_, sOk := r.URL.Query()["s"]
+	mode := r.URL.Query().Get("mode")
+
+	shape, radius, background, err := shapeFromQuery(r.URL.Query())
+	if err != nil {
+		JsonResponseMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	if hOk && wOk {
-		height, err = strconv.ParseUint(r.URL.Query().Get("h"), 10, 64)
-		if err != nil {
-			JsonResponseMsg(w, http.StatusBadRequest, `"h" parameter should be an integer`)
+		if height, err = parseImageSize(r.URL.Query(), "h"); err != nil {
+			JsonResponseMsg(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		width, err = strconv.ParseUint(r.URL.Query().Get("w"), 10, 64)
-		if err != nil {
-			JsonResponseMsg(w, http.StatusBadRequest, `"w" parameter should be an integer`)
+		if width, err = parseImageSize(r.URL.Query(), "w"); err != nil {
+			JsonResponseMsg(w, http.StatusBadRequest, err.Error())
 			return
 		}
 	} else if sOk {
-		size, err = strconv.ParseUint(r.URL.Query().Get("s"), 10, 64)
-		if err != nil {
-			JsonResponseMsg(w, http.StatusBadRequest, `"s" parameter should be an integer`)
+		if size, err = parseImageSize(r.URL.Query(), "s"); err != nil {
+			JsonResponseMsg(w, http.StatusBadRequest, err.Error())
 			return
 		}
-	} else {
+	} else if shape == "" && mode == "" {
 		JsonResponseMsg(w, http.StatusBadRequest, `incorrect query parameters`)
 		return
 	}
 
-	file := buf.(*bytes.Buffer)
+	if mode != "" && mode != ModeSmart {
+		JsonResponseMsg(w, http.StatusBadRequest, `"mode" parameter should be "smart"`)
+		return
+	}
+
+	if !limitResize(c, w, r) {
+		return
+	}
+
+	file := buf
 	fileBytesArray, filetype, err := getFileType(file)
 	if err != nil {
 		JsonResponseMsg(w, http.StatusInternalServerError, `can't read the file`)
 		return
 	}
 
-	w.Header().Set("Content-Type", filetype)
-
 	// decode image file into image.Image
-	img, _, err := image.Decode(bytes.NewReader(fileBytesArray))
+	end := startProcessing(r.Context(), "decode")
+	img, _, err := image.Decode(newContextReader(r.Context(), bytes.NewReader(fileBytesArray)))
+	end(err)
 	if err != nil {
-		JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
+		JsonResponseError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	if mode == ModeSmart {
+		end = startProcessing(r.Context(), "crop")
+		rect := smartCrop(img, 1, 1)
+		if hOk && wOk {
+			rect = smartCrop(img, int(width), int(height))
+		}
+		img, err = cropImage(img, rect)
+		end(err)
+		if err != nil {
+			JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if requestDone(w, r) {
+			return
+		}
+	}
+
+	resizedImage = img
+	end = startProcessing(r.Context(), "resize")
 	if hOk && wOk {
 		resizedImage = resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
 	} else if sOk {
 		resizedImage = resize.Thumbnail(uint(size), uint(size), img, resize.Lanczos3)
 	}
+	end(nil)
+	if requestDone(w, r) {
+		return
+	}
+
+	if shape != "" {
+		end = startProcessing(r.Context(), "shape")
+		resizedImage, filetype = shapeImage(resizedImage, filetype, shape, radius, background)
+		end(nil)
+		if requestDone(w, r) {
+			return
+		}
+	}
 
 	// check if file type is supported
 	if ok := contains(supportedMediaTypes, filetype); !ok {
@@ -150,26 +366,187 @@ func GetResizedFile(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	end = startProcessing(r.Context(), "encode")
+	encodeToResponse(&contextResponseWriter{w, r.Context()}, resizedImage, filetype)
+	end(r.Context().Err())
+	return
+}
+
+// Parameters of the generated default image. Clients may send them with
+// every request, so they are ignored once the avatar is uploaded.
+// Parse the size parameter of the resized image. Sizes above MaxImageSize
+// are refused, they would allocate too much memory.
+func parseImageSize(query url.Values, name string) (uint64, error) {
+	size, err := strconv.ParseUint(query.Get(name), 10, 64)
+	if err != nil {
+		return 0, errors.New(`"` + name + `" parameter should be an integer`)
+	}
+	if size == 0 || size > MaxImageSize {
+		return 0, errors.New(`"` + name + `" parameter should be between 1 and ` + strconv.Itoa(MaxImageSize))
+	}
+	return size, nil
+}
+
+var defaultImageParams = []string{"d", "name", "format"}
+
+// Remove the parameters of the default image from the request query.
+func dropDefaultParams(r *http.Request) {
+	query := r.URL.Query()
+	for _, key := range defaultImageParams {
+		if _, ok := query[key]; ok {
+			query.Del(key)
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+}
+
+// Serve generated image for the id which has no uploaded avatar.
+func GetDefaultFile(c web.C, w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	style := r.URL.Query().Get("d")
+	if style == "" {
+		style = IdenticonGrid
+	}
+	if !isValidIdenticon(style) && style != DefaultInitials {
+		JsonResponseMsg(w, http.StatusBadRequest, `"d" parameter should be "identicon", "geometric" or "initials"`)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if style == DefaultInitials && initials(name) == "" {
+		JsonResponseMsg(w, http.StatusBadRequest, `"name" parameter should contain letters`)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "png" && format != "svg" {
+		JsonResponseMsg(w, http.StatusBadRequest, `"format" parameter should be "png" or "svg"`)
+		return
+	}
+	if format == "svg" && style != DefaultInitials {
+		JsonResponseMsg(w, http.StatusBadRequest, `"svg" format is supported for initials only`)
+		return
+	}
+
+	size := uint64(DefaultImageSize)
+	if _, ok := r.URL.Query()["s"]; ok {
+		size, err = strconv.ParseUint(r.URL.Query().Get("s"), 10, 64)
+		if err != nil {
+			JsonResponseMsg(w, http.StatusBadRequest, `"s" parameter should be an integer`)
+			return
+		}
+	}
+	if size == 0 || size > MaxImageSize {
+		JsonResponseMsg(w, http.StatusBadRequest, `"s" parameter should be between 1 and `+strconv.Itoa(MaxImageSize))
+		return
+	}
+
+	shape, radius, background, err := shapeFromQuery(r.URL.Query())
+	if err != nil {
+		JsonResponseMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// generated image is replaced as soon as avatar is uploaded, so it should be revalidated
+	if cacheResponse(w, r, "no-cache", variantETag("default:"+c.URLParams["id"], r.URL.Query()), time.Time{}) {
+		return
+	}
+
+	if format == "svg" {
+		if shape == ShapeRounded && radius == 0 {
+			radius = size / 8
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(renderInitialsSVG(c.URLParams["id"], name, int(size), shape, int(radius)))
+		return
+	}
+
+	var img image.Image
+	if style == DefaultInitials {
+		img, err = renderInitials(c.URLParams["id"], name, int(size))
+		if err != nil {
+			JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		img = renderIdenticon(c.URLParams["id"], style, int(size))
+	}
+	filetype := "image/png"
+	if shape != "" {
+		img, filetype = shapeImage(img, filetype, shape, radius, background)
+	}
+
+	encodeToResponse(&contextResponseWriter{w, r.Context()}, img, filetype)
+	return
+}
+
+// Check whether the request is canceled or timed out and respond with the
+// error if so. Used between image processing steps.
+func requestDone(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.Context().Err(); err != nil {
+		JsonResponseError(w, http.StatusInternalServerError, err)
+		return true
+	}
+	return false
+}
+
+// Parse "shape", "r" and "bg" query parameters.
+func shapeFromQuery(query url.Values) (shape string, radius uint64, background color.Color, err error) {
+	shape = query.Get("shape")
+	if shape == "" {
+		return
+	}
+	if !isValidShape(shape) {
+		err = errors.New(`"shape" parameter should be "circle" or "rounded"`)
+		return
+	}
+	if _, ok := query["r"]; ok {
+		if radius, err = strconv.ParseUint(query.Get("r"), 10, 64); err != nil {
+			err = errors.New(`"r" parameter should be an integer`)
+			return
+		}
+	}
+	if _, ok := query["bg"]; ok {
+		if background, err = parseHexColor(query.Get("bg")); err != nil {
+			err = errors.New(`"bg" parameter should be hex color string`)
+			return
+		}
+	}
+	return
+}
+
+// Cut the image with the shape and get the file type it should be encoded with.
+func shapeImage(img image.Image, filetype string, shape string, radius uint64, background color.Color) (image.Image, string) {
+	if shape == ShapeRounded && radius == 0 {
+		radius = uint64(img.Bounds().Dx() / 8)
+	}
+	img = applyShape(img, shape, int(radius), background)
+	// cut corners need alpha channel unless they are filled with background
+	if background == nil {
+		filetype = "image/png"
+	}
+	return img, filetype
+}
+
+// Encode image with the given file type into response.
+func encodeToResponse(w http.ResponseWriter, img image.Image, filetype string) {
+	w.Header().Set("Content-Type", filetype)
+
 	switch filetype {
 	case "image/jpeg", "image/jpg":
-		jpeg.Encode(w, resizedImage, nil)
+		jpeg.Encode(w, img, nil)
 	case "image/bmp":
-		bmp.Encode(w, resizedImage)
+		bmp.Encode(w, img)
 	case "image/png":
-		png.Encode(w, resizedImage)
+		png.Encode(w, img)
 	case "image/gif":
-		gif.Encode(w, resizedImage, nil)
+		gif.Encode(w, img, nil)
 	}
 	return
 }
 
-func imageToResponse(fn func(string) (interface{}, error), id string, w http.ResponseWriter) {
-	buf, err := fn(id)
-	if err != nil {
-		JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
+func bufferToResponse(buf interface{}, w http.ResponseWriter) {
 	file := buf.(*bytes.Buffer)
 	fileBytesArray, filetype, err := getFileType(file)
 	if err != nil {
@@ -184,82 +561,242 @@ func imageToResponse(fn func(string) (interface{}, error), id string, w http.Res
 	return
 }
 
+// Size limit of the non-file fields of the upload form.
+const maxFormFieldSize = 64 * 1024
+
+// Header and query parameter with the mask of the raw body upload:
+// comma separated "x0,y0,x1,y1".
+const (
+	MaskHeader = "X-Mask"
+	MaskParam  = "mask"
+)
+
+// JSON upload with base64 encoded file.
+type JsonUpload struct {
+	Data     string `json:"data"`
+	Mask     []int  `json:"mask"`
+	Filename string `json:"filename"`
+}
+
+// Store the file uploaded as multipart form with "files" and "config"
+// fields, JSON object with base64 encoded "data" or raw image body. All of
+// them are checked the same way by storeUploadedFile and InsertAvatar.
 func uploadFile(c web.C, w http.ResponseWriter, r *http.Request, isNew bool) {
-	//parse the multipart form in the request
-	err := r.ParseMultipartForm(100000)
+	var (
+		stored *ImageInfo
+		mask   []int
+		status int
+		err    error
+	)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/json":
+		stored, mask, status, err = readJsonUpload(w, r)
+	case strings.HasPrefix(mediaType, "image/"):
+		stored, mask, status, err = readRawUpload(r)
+	default:
+		stored, mask, status, err = readMultipartUpload(r)
+	}
 	if err != nil {
-		JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
+		if stored != nil {
+			RemoveImageFile(context.Background(), stored.Id)
+		}
+		JsonResponseMsg(w, status, err.Error())
 		return
 	}
+	insertUploadedAvatar(c, w, r, stored, mask, isNew)
+	return
+}
 
-	mask := Mask{}
-	value := r.FormValue("config")
-	if len(value) > 0 {
-		if err := json.Unmarshal([]byte(value), &mask); err != nil {
-			JsonResponseMsg(w, http.StatusBadRequest, `field "config" should be json-string`)
-			return
-		}
-		if len(mask.Mask) != 4 {
-			JsonResponseMsg(w, http.StatusBadRequest, `field "config" should contain 4 integer elements`)
-			return
+// Make the stored file the avatar of "Id" URL parameter and respond with
+// the avatar.
+func insertUploadedAvatar(c web.C, w http.ResponseWriter, r *http.Request, stored *ImageInfo, mask []int, isNew bool) {
+	idObj := c.URLParams["id"]
+	err := InsertAvatar(r.Context(), idObj, stored.Id, mask, isNew)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "not found" {
+			status = http.StatusNotFound
+		} else if err == errAvatarExists {
+			status = http.StatusConflict
+		} else if err == errMaskRect || err == errMaskOutOfBounds {
+			status = http.StatusBadRequest
 		}
+		JsonResponseError(w, status, err)
+		return
 	}
 
-	//get a ref to the parsed multipart form
-	files := r.MultipartForm.File["files"]
-	for i, _ := range files {
-		file, err := files[i].Open()
-		if err != nil {
-			JsonResponseMsg(w, http.StatusInternalServerError, `can't open the file`)
-			return
-		}
-		defer file.Close()
-
-		filename := filepath.Base(files[i].Filename)
+	avatar, err := GetAvatarStructById(r.Context(), idObj)
+	if err != nil {
+		JsonResponseError(w, http.StatusInternalServerError, err)
+		return
+	}
+	JsonResponseFromStruct(w, http.StatusCreated, avatar)
+	return
+}
 
-		// get file type
-		fileBytesArray, filetype, err := getFileType(file)
+// Read the multipart form part by part, the file is streamed into storage
+// as it arrives. Only the first file is stored.
+func readMultipartUpload(r *http.Request) (stored *ImageInfo, mask []int, status int, err error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			JsonResponseMsg(w, http.StatusInternalServerError, `can't read the file`)
-			return
+			return stored, nil, http.StatusBadRequest, err
 		}
 
-		// check file size
-		if err = checkFileSize(file); err != nil {
-			JsonResponseMsg(w, http.StatusRequestEntityTooLarge, err.Error())
-			return
+		switch part.FormName() {
+		case "config":
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if err != nil {
+				part.Close()
+				return stored, nil, http.StatusBadRequest, err
+			}
+			if len(value) > 0 {
+				var config Mask
+				if err := json.Unmarshal(value, &config); err != nil {
+					part.Close()
+					return stored, nil, http.StatusBadRequest, errors.New(`field "config" should be json-string`)
+				}
+				if config.Mask == nil {
+					// the config is sent only to set the mask, so it is required
+					config.Mask = []int{}
+				}
+				if mask, err = checkMask("config", config.Mask); err != nil {
+					part.Close()
+					return stored, nil, http.StatusBadRequest, err
+				}
+			}
+		case "files":
+			if stored == nil {
+				stored, status, err = storeUploadedFile(r.Context(), part, filepath.Base(part.FileName()))
+				if err != nil {
+					part.Close()
+					return nil, nil, status, err
+				}
+			}
 		}
+		part.Close()
+	}
+	if stored == nil {
+		return nil, nil, http.StatusBadRequest, errors.New(`bad request`)
+	}
+	return stored, mask, 0, nil
+}
 
-		// check if file type is supported
-		if ok := contains(supportedMediaTypes, filetype); !ok {
-			JsonResponseMsg(w, http.StatusUnsupportedMediaType, `UNSUPPORTED_MEDIA_TYPE`)
-			return
+// Read the JSON upload. The body is limited by the size of the base64
+// encoded file.
+func readJsonUpload(w http.ResponseWriter, r *http.Request) (stored *ImageInfo, mask []int, status int, err error) {
+	var upload JsonUpload
+	body := http.MaxBytesReader(w, r.Body, int64(base64.StdEncoding.EncodedLen(MaxFileSize)+maxFormFieldSize))
+	if err = json.NewDecoder(body).Decode(&upload); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, nil, http.StatusRequestEntityTooLarge, ErrFileTooLarge
 		}
+		return nil, nil, http.StatusBadRequest, errors.New(`body should be json object with "data" field`)
+	}
+	if mask, err = checkMask("mask", upload.Mask); err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	data, err := base64.StdEncoding.DecodeString(upload.Data)
+	if err != nil || len(data) == 0 {
+		return nil, nil, http.StatusBadRequest, errors.New(`field "data" should be base64 encoded file`)
+	}
+	stored, status, err = storeUploadedFile(r.Context(), bytes.NewReader(data), uploadFilename(upload.Filename))
+	return stored, mask, status, err
+}
 
-		idObj := c.URLParams["id"]
-		if mask.Mask != nil {
-			err = InsertImageAndThumbnail(idObj, fileBytesArray, filename, mask.Mask, isNew)
-		} else {
-			err = InsertImage(idObj, fileBytesArray, filename, isNew)
-		}
-		if err != nil {
-			status := http.StatusInternalServerError
-			if err.Error() == "not found" {
-				status = http.StatusNotFound
+// Read the raw image body. The mask is taken from "X-Mask" header or "mask"
+// query parameter, the file name from "Content-Disposition" header.
+func readRawUpload(r *http.Request) (stored *ImageInfo, mask []int, status int, err error) {
+	value := r.Header.Get(MaskHeader)
+	if value == "" {
+		value = r.URL.Query().Get(MaskParam)
+	}
+	if value != "" {
+		var config []int
+		for _, s := range strings.Split(value, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return nil, nil, http.StatusBadRequest, errors.New(`mask should contain 4 comma separated integers`)
 			}
-			JsonResponseMsg(w, status, err.Error())
-			return
+			config = append(config, n)
+		}
+		if mask, err = checkMask("mask", config); err != nil {
+			return nil, nil, http.StatusBadRequest, err
 		}
+	}
 
-		avatar, err := GetAvatarStructById(idObj)
-		if err != nil {
-			JsonResponseMsg(w, http.StatusInternalServerError, err.Error())
-			return
+	var filename string
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+		filename = params["filename"]
+	}
+	stored, status, err = storeUploadedFile(r.Context(), r.Body, uploadFilename(filename))
+	return stored, mask, status, err
+}
+
+// Check that the mask is not set (nil) or contains 4 elements of the
+// rectangle. The mask which is set but empty is invalid. Bounds of the
+// image are checked by InsertAvatar.
+func checkMask(field string, mask []int) ([]int, error) {
+	if mask == nil {
+		return nil, nil
+	}
+	if len(mask) != 4 {
+		return nil, errors.New(`field "` + field + `" should contain 4 integer elements`)
+	}
+	if err := checkMaskRect(mask); err != nil {
+		return nil, err
+	}
+	return mask, nil
+}
+
+// Get base name of the uploaded file, "avatar" if it is not set.
+func uploadFilename(filename string) string {
+	if filename = filepath.Base(filename); filename == "." || filename == "/" {
+		return "avatar"
+	}
+	return filename
+}
+
+// Stream the uploaded file into storage. Content type is sniffed from the
+// first 512 bytes and the size is checked as the bytes arrive. Returns the
+// status code which should be responded with on error.
+func storeUploadedFile(ctx context.Context, file io.Reader, filename string) (*ImageInfo, int, error) {
+	reader := newSizeLimitReader(file, MaxFileSize)
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		if err == ErrFileTooLarge {
+			return nil, http.StatusRequestEntityTooLarge, err
 		}
-		JsonResponseFromStruct(w, http.StatusCreated, avatar)
-		return
+		return nil, http.StatusInternalServerError, errors.New(`can't read the file`)
 	}
+	head = head[:n]
 
-	JsonResponseMsg(w, http.StatusBadRequest, `bad request`)
-	return
+	// check if file type is supported
+	if ok := contains(supportedMediaTypes, http.DetectContentType(head)); !ok {
+		return nil, http.StatusUnsupportedMediaType, errors.New(`UNSUPPORTED_MEDIA_TYPE`)
+	}
+
+	info, err := StoreImageFile(ctx, io.MultiReader(bytes.NewReader(head), reader), filename)
+	if err == ErrFileTooLarge {
+		return nil, http.StatusRequestEntityTooLarge, err
+	}
+	if err == context.DeadlineExceeded {
+		return nil, http.StatusGatewayTimeout, errors.New(`request timeout`)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	uploadSize.Observe(float64(info.Size))
+	return info, http.StatusOK, nil
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+type UploadSuiteTester struct {
+	BaseSuite
+
+	mux *web.Mux
+}
+
+// Settings for suite
+func (suite *UploadSuiteTester) SetupSuite() {
+	// INIT router with upload handler
+	suite.mux = web.New()
+	suite.mux.Post("/:id", UploadFile)
+	suite.mux.Patch("/:id", ChangeMask)
+}
+
+// Send upload request with given content type and body.
+func (suite *UploadSuiteTester) upload(url string, contentType string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	return w
+}
+
+// Test validation of JSON upload
+func (suite *UploadSuiteTester) TestJsonUpload() {
+	id := "/" + RandomMD5()
+
+	// WHEN I send body which is not JSON object
+	w := suite.upload(id, "application/json", `"data"`, nil)
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+
+	// WHEN I send data which is not base64
+	w = suite.upload(id, "application/json", `{"data": "not base64!"}`, nil)
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+	suite.Contains(w.Body.String(), `field \"data\" should be base64 encoded file`)
+
+	// WHEN I send mask with 3 elements
+	w = suite.upload(id, "application/json", `{"data": "aGVsbG8=", "mask": [1, 2, 3]}`, nil)
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+
+	// WHEN I send empty mask
+	w = suite.upload(id, "application/json", `{"data": "aGVsbG8=", "mask": []}`, nil)
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+
+	// WHEN I send text file
+	w = suite.upload(id, "application/json", `{"data": "aGVsbG8="}`, nil)
+	// THEN response status code should be 415
+	suite.Equal(http.StatusUnsupportedMediaType, w.Code)
+}
+
+// Test validation of raw body upload
+func (suite *UploadSuiteTester) TestRawUpload() {
+	id := "/" + RandomMD5()
+
+	// WHEN I send mask which is not integers in header
+	w := suite.upload(id, "image/png", "hello", map[string]string{MaskHeader: "1,2,x,4"})
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+
+	// WHEN I send mask with 2 elements in query
+	w = suite.upload(id+"?"+MaskParam+"=1,2", "image/png", "hello", nil)
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+
+	// WHEN I send text file as image
+	w = suite.upload(id, "image/png", "hello", nil)
+	// THEN response status code should be 415
+	suite.Equal(http.StatusUnsupportedMediaType, w.Code)
+}
+
+// Test validation of multipart upload config
+func (suite *UploadSuiteTester) TestMultipartConfig() {
+	id := "/" + RandomMD5()
+	for _, config := range []string{`{}`, `{"mask": []}`, `{"mask": [1, 2]}`} {
+		// WHEN I send config without valid mask
+		body := bytes.NewBuffer(nil)
+		writer := multipart.NewWriter(body)
+		writer.WriteField("config", config)
+		part, _ := writer.CreateFormFile("files", "avatar.png")
+		part.Write([]byte("hello"))
+		writer.Close()
+		w := suite.upload(id, writer.FormDataContentType(), body.String(), nil)
+		// THEN response status code should be 400
+		suite.Equal(http.StatusBadRequest, w.Code, config)
+		suite.Contains(w.Body.String(), `field \"config\" should contain 4 integer elements`, config)
+	}
+}
+
+// Test validation of the changed mask
+func (suite *UploadSuiteTester) TestChangeMaskGeometry() {
+	for _, mask := range []string{"[20, 10, 10, 20]", "[10, 20, 20, 20]", "[-1, 0, 10, 10]"} {
+		// WHEN I change the mask to inverted, empty or negative rectangle
+		r, err := http.NewRequest("PATCH", "/"+RandomMD5(), strings.NewReader(`{"mask": `+mask+`}`))
+		if err != nil {
+			suite.T().Error(err.Error())
+		}
+		w := httptest.NewRecorder()
+		suite.mux.ServeHTTP(w, r)
+		// THEN response status code should be 400
+		suite.Equal(http.StatusBadRequest, w.Code, mask)
+	}
+}
+
+// Test validation of the uploaded mask
+func (suite *UploadSuiteTester) TestUploadMaskGeometry() {
+	id := "/" + RandomMD5()
+	for _, mask := range []string{"20,10,10,20", "10,20,20,20", "-1,0,10,10"} {
+		// WHEN I upload JSON with inverted, empty or negative rectangle
+		w := suite.upload(id, "application/json", `{"data": "aGVsbG8=", "mask": [`+mask+`]}`, nil)
+		// THEN response status code should be 400
+		suite.Equal(http.StatusBadRequest, w.Code, mask)
+		suite.Contains(w.Body.String(), "mask should be [x0, y0, x1, y1]", mask)
+
+		// WHEN I upload raw body with the mask
+		w = suite.upload(id, "image/png", "hello", map[string]string{MaskHeader: mask})
+		// THEN response status code should be 400
+		suite.Equal(http.StatusBadRequest, w.Code, mask)
+
+		// WHEN I upload multipart form with the mask in config
+		body := bytes.NewBuffer(nil)
+		writer := multipart.NewWriter(body)
+		writer.WriteField("config", `{"mask": [`+mask+`]}`)
+		part, _ := writer.CreateFormFile("files", "avatar.png")
+		part.Write([]byte("hello"))
+		writer.Close()
+		w = suite.upload(id, writer.FormDataContentType(), body.String(), nil)
+		// THEN response status code should be 400
+		suite.Equal(http.StatusBadRequest, w.Code, mask)
+	}
+}
+
+// Test parsing of the uploaded file name
+func (suite *UploadSuiteTester) TestUploadFilename() {
+	suite.Equal("avatar", uploadFilename(""))
+	suite.Equal("avatar", uploadFilename("/"))
+	suite.Equal("me.png", uploadFilename("../../me.png"))
+}
+
+// TestRunUploadSuite will be run by the 'go test' command
+func TestRunUploadSuite(t *testing.T) {
+	Run(t, new(UploadSuiteTester))
+}
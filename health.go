@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/drone/config"
+)
+
+const (
+	HealthUrl    = BaseUrl + `healthz`
+	ReadinessUrl = BaseUrl + `readyz`
+)
+
+var ReadinessTimeout = config.Duration("readiness-timeout", 2*time.Second)
+
+// Check whether the storage backend is available. Replaced in tests.
+var checkReadiness = func(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, *ReadinessTimeout)
+	defer cancel()
+	return PingStorage(ctx)
+}
+
+// Healthz responds while the process is alive.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	JsonResponseMsg(w, http.StatusOK, `ok`)
+}
+
+// Readyz responds with "503 Service Unavailable" if the storage backend
+// doesn't respond to ping within "readiness-timeout".
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	if err := checkReadiness(r.Context()); err != nil {
+		JsonResponseMsg(w, http.StatusServiceUnavailable, `storage is unavailable: `+err.Error())
+		return
+	}
+	JsonResponseMsg(w, http.StatusOK, `ok`)
+}
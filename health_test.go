@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type HealthSuiteTester struct {
+	BaseSuite
+
+	check func(context.Context) error
+}
+
+// Settings for suite
+func (suite *HealthSuiteTester) SetupSuite() {
+	// INIT keep the storage check
+	suite.check = checkReadiness
+}
+
+// Restore the storage check after suite
+func (suite *HealthSuiteTester) TearDownSuite() {
+	checkReadiness = suite.check
+}
+
+func (suite *HealthSuiteTester) request(handler http.HandlerFunc) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// Test liveness
+func (suite *HealthSuiteTester) TestHealthz() {
+	// GIVEN unavailable storage
+	checkReadiness = func(context.Context) error { return errors.New("no reachable servers") }
+	// WHEN I check liveness
+	w := suite.request(Healthz)
+	// THEN the process should be alive anyway
+	suite.Equal(http.StatusOK, w.Code)
+}
+
+// Test readiness
+func (suite *HealthSuiteTester) TestReadyz() {
+	// GIVEN available storage
+	checkReadiness = func(context.Context) error { return nil }
+	// WHEN I check readiness
+	w := suite.request(Readyz)
+	// THEN service should be ready
+	suite.Equal(http.StatusOK, w.Code)
+
+	// GIVEN unavailable storage
+	checkReadiness = func(context.Context) error { return errors.New("no reachable servers") }
+	// WHEN I check readiness
+	w = suite.request(Readyz)
+	// THEN service should be unavailable
+	suite.Equal(http.StatusServiceUnavailable, w.Code)
+	suite.Contains(w.Body.String(), "no reachable servers")
+}
+
+// Test that ping doesn't outlive the context while dialing
+func (suite *HealthSuiteTester) TestPingTimeout() {
+	// GIVEN unreachable server and long dial timeout
+	url, dialTimeout := *mongoUrl, *MongoDialTimeout
+	*mongoUrl, *MongoDialTimeout = "mongodb://127.0.0.1:1/avatars", time.Minute
+	defer func() {
+		*mongoUrl, *MongoDialTimeout = url, dialTimeout
+		mgoDialErr = nil
+	}()
+
+	// WHEN I ping the storage with short deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := PingStorage(ctx)
+	// THEN ping should fail by the deadline
+	suite.NotNil(err)
+	suite.True(time.Since(start) < 5*time.Second, time.Since(start).String())
+}
+
+// TestRunHealthSuite will be run by the 'go test' command
+func TestRunHealthSuite(t *testing.T) {
+	Run(t, new(HealthSuiteTester))
+}
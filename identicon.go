@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/md5"
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	IdenticonGrid      = "identicon"
+	IdenticonGeometric = "geometric"
+)
+
+const (
+	DefaultImageSize = 256
+	MaxImageSize     = 2048
+)
+
+var identiconBackground = color.NRGBA{0xf0, 0xf0, 0xf0, 0xff}
+
+// Check whether the identicon style is supported.
+func isValidIdenticon(style string) bool {
+	return style == IdenticonGrid || style == IdenticonGeometric
+}
+
+// Render identicon of the given style for the id.
+func renderIdenticon(id string, style string, size int) image.Image {
+	hash := md5.Sum([]byte(id))
+	if style == IdenticonGeometric {
+		return renderGeometricIdenticon(hash, size)
+	}
+	return renderGridIdenticon(hash, size)
+}
+
+// Render 5x5 horizontally mirrored grid like GitHub does.
+func renderGridIdenticon(hash [md5.Size]byte, size int) image.Image {
+	const cells = 5
+	fg := hashColor(hash)
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+
+	var grid [cells][cells]bool
+	for i := 0; i < cells*3; i++ {
+		col, row := i/cells, i%cells
+		on := (hash[i/2]>>(uint(i%2)*4))&1 == 0
+		grid[row][col] = on
+		grid[row][cells-1-col] = on
+	}
+
+	// half of the cell is used as a margin on each side
+	cell := float64(size) / (cells + 1)
+	margin := cell / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.Set(x, y, identiconBackground)
+			col := int(math.Floor((float64(x) + 0.5 - margin) / cell))
+			row := int(math.Floor((float64(y) + 0.5 - margin) / cell))
+			if col >= 0 && col < cells && row >= 0 && row < cells && grid[row][col] {
+				img.Set(x, y, fg)
+			}
+		}
+	}
+	return img
+}
+
+// Patches of the geometric identicon. Every patch is a polygon inside of
+// the unit square.
+var identiconPatches = [][][2]float64{
+	{{0, 0}, {1, 0}, {1, 1}, {0, 1}},
+	{{0, 0}, {1, 0}, {0, 1}},
+	{{0, 0}, {1, 0}, {0.5, 1}},
+	{{0, 0}, {0.5, 0}, {0.5, 1}, {0, 1}},
+	{{0.5, 0}, {1, 0.5}, {0.5, 1}, {0, 0.5}},
+	{{0.25, 0.25}, {0.75, 0.25}, {0.75, 0.75}, {0.25, 0.75}},
+	{{0, 0}, {1, 0.5}, {0.5, 1}},
+	{{0.5, 0.5}, {1, 0}, {1, 1}, {0, 1}},
+}
+
+// Render 4x4 pattern of rotationally symmetric patches like Gravatar does.
+func renderGeometricIdenticon(hash [md5.Size]byte, size int) image.Image {
+	const cells = 4
+	fg := hashColor(hash)
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+
+	corner := identiconPatches[int(hash[3])%len(identiconPatches)]
+	side := identiconPatches[int(hash[4])%len(identiconPatches)]
+	center := identiconPatches[int(hash[5])%len(identiconPatches)]
+	turn := int(hash[6]) % 4
+	invert := hash[7]&1 == 1
+
+	cell := float64(size) / cells
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			fx, fy := (float64(x)+0.5)/cell, (float64(y)+0.5)/cell
+			col, row := int(fx), int(fy)
+			if col >= cells {
+				col = cells - 1
+			}
+			if row >= cells {
+				row = cells - 1
+			}
+			u, v := fx-float64(col), fy-float64(row)
+
+			// every ring of cells is rotated around the image center
+			var patch [][2]float64
+			switch {
+			case (col == 0 || col == cells-1) && (row == 0 || row == cells-1):
+				patch = corner
+			case col == 0 || col == cells-1 || row == 0 || row == cells-1:
+				patch = side
+			default:
+				patch = center
+			}
+			quarter := turn
+			switch {
+			case col >= cells/2 && row < cells/2:
+				quarter += 1
+			case col >= cells/2 && row >= cells/2:
+				quarter += 2
+			case col < cells/2 && row >= cells/2:
+				quarter += 3
+			}
+			for i := 0; i < quarter%4; i++ {
+				u, v = v, 1-u
+			}
+
+			if insidePolygon(patch, u, v) != invert {
+				img.Set(x, y, fg)
+			} else {
+				img.Set(x, y, identiconBackground)
+			}
+		}
+	}
+	return img
+}
+
+// Check whether the point lies inside the polygon (ray casting).
+func insidePolygon(polygon [][2]float64, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := polygon[i][0], polygon[i][1]
+		xj, yj := polygon[j][0], polygon[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Get the color for the id.
+func idColor(id string) color.NRGBA {
+	return hashColor(md5.Sum([]byte(id)))
+}
+
+// Derive saturated color from the hash.
+func hashColor(hash [md5.Size]byte) color.NRGBA {
+	hue := float64(uint16(hash[13])<<8|uint16(hash[14])) / 0xffff
+	saturation := 0.45 + float64(hash[15]%20)/100
+	lightness := 0.5 + float64(hash[12]%15)/100
+	return hslToRGB(hue, saturation, lightness)
+}
+
+// Convert HSL color with components in [0, 1] range to RGB.
+func hslToRGB(h, s, l float64) color.NRGBA {
+	var q float64
+	if l < 0.5 {
+		q = l * (1 + s)
+	} else {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	hue := func(t float64) uint8 {
+		if t < 0 {
+			t += 1
+		}
+		if t > 1 {
+			t -= 1
+		}
+		var v float64
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 1.0/2:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		default:
+			v = p
+		}
+		return uint8(math.Round(v * 0xff))
+	}
+	return color.NRGBA{hue(h + 1.0/3), hue(h), hue(h - 1.0/3), 0xff}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+type IdenticonSuiteTester struct {
+	BaseSuite
+
+	mux *web.Mux
+}
+
+// Settings for suite
+func (suite *IdenticonSuiteTester) SetupSuite() {
+	// INIT test router with default file handler
+	suite.mux = web.New()
+	suite.mux.Get("/:id", GetDefaultFile)
+}
+
+// Test identicons are deterministic
+func (suite *IdenticonSuiteTester) TestDeterministic() {
+	for _, style := range []string{IdenticonGrid, IdenticonGeometric} {
+		// GIVEN two different ids
+		id, otherId := RandomMD5(), RandomMD5()
+
+		// WHEN I render identicon for the same id twice
+		first := renderIdenticon(id, style, 60).(*image.NRGBA)
+		second := renderIdenticon(id, style, 60).(*image.NRGBA)
+		// AND render identicon for another id
+		other := renderIdenticon(otherId, style, 60).(*image.NRGBA)
+		// THEN images of the same id should be equal
+		suite.Equal(first.Pix, second.Pix, style)
+		// AND images of different ids should differ
+		suite.NotEqual(first.Pix, other.Pix, style)
+		// AND image should have requested size
+		suite.Equal(image.Rect(0, 0, 60, 60), first.Bounds(), style)
+	}
+}
+
+// Test serving identicon for the id without avatar
+func (suite *IdenticonSuiteTester) TestDefaultFile() {
+	// WHEN I request geometric identicon of size 32
+	r, err := http.NewRequest("GET", "/"+RandomMD5()+"?d=geometric&s=32", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	// THEN response status code should be 200
+	suite.Equal(http.StatusOK, w.Code)
+	// AND response should be PNG image of requested size
+	suite.Equal("image/png", w.Header().Get("Content-Type"))
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal(image.Rect(0, 0, 32, 32), img.Bounds())
+}
+
+// Test removing parameters of the default image
+func (suite *IdenticonSuiteTester) TestDropDefaultParams() {
+	// GIVEN request with default image and resizing parameters
+	r, err := http.NewRequest("GET", "/"+RandomMD5()+"?d=initials&name=John&format=svg&s=32", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// WHEN I drop default image parameters
+	dropDefaultParams(r)
+	// THEN only resizing parameters should be left
+	suite.Equal("s=32", r.URL.RawQuery)
+}
+
+// Test parsing sizes of the resized image
+func (suite *IdenticonSuiteTester) TestParseImageSize() {
+	size, err := parseImageSize(url.Values{"w": {"64"}}, "w")
+	suite.Nil(err)
+	suite.Equal(uint64(64), size)
+	for _, value := range []string{"0", "100000", "-1", "abc", "18446744073709551615"} {
+		_, err = parseImageSize(url.Values{"w": {value}}, "w")
+		suite.NotNil(err, value)
+	}
+}
+
+// Test serving identicon with invalid parameters
+func (suite *IdenticonSuiteTester) TestDefaultFileInvalidParams() {
+	for _, query := range []string{"d=unknown", "s=0", "s=100000", "s=abc"} {
+		// WHEN I request identicon with invalid query
+		r, err := http.NewRequest("GET", "/"+RandomMD5()+"?"+query, nil)
+		if err != nil {
+			suite.T().Error(err.Error())
+		}
+		w := httptest.NewRecorder()
+		suite.mux.ServeHTTP(w, r)
+		// THEN response status code should be 400
+		suite.Equal(http.StatusBadRequest, w.Code, query)
+	}
+}
+
+// TestRunIdenticonSuite will be run by the 'go test' command
+func TestRunIdenticonSuite(t *testing.T) {
+	Run(t, new(IdenticonSuiteTester))
+}
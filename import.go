@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/drone/config"
+	"github.com/zenazn/goji/web"
+)
+
+var (
+	ImportTimeout      = config.Duration("import-timeout", 10*time.Second)
+	ImportMaxRedirects = config.Int("import-max-redirects", 3)
+)
+
+var (
+	errForbiddenAddress = errors.New(`url points to forbidden address`)
+	errTooManyRedirects = errors.New(`too many redirects`)
+	errImportUrl        = errors.New(`field "url" should be absolute http or https url`)
+)
+
+// Ranges which are not routed in the public internet besides the ones
+// recognized by net.IP methods.
+var reservedNets = parseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+)
+
+// Import of the avatar from the remote URL.
+type ImportUpload struct {
+	Url  string `json:"url"`
+	Mask []int  `json:"mask"`
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = ipNet
+	}
+	return nets
+}
+
+// Check if the address is routed in the public internet.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, ipNet := range reservedNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether avatars may be imported from the address. Replaced in tests
+// to reach local servers.
+var allowImportIP = isPublicIP
+
+// Check that the avatar to import doesn't exist yet. Replaced in tests
+// which run without storage.
+var checkImportTarget = checkForExistedImage
+
+func checkImportUrl(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errImportUrl
+	}
+	return nil
+}
+
+// Build the client which fetches imported files. Addresses are checked when
+// the connection is made, so host names resolving to private addresses and
+// redirects to them are refused too. Proxies from the environment are not
+// used, they would hide the address.
+func newImportClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: *ImportTimeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allowImportIP(ip) {
+				return errForbiddenAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: *ImportTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: *ImportTimeout,
+			DisableKeepAlives:   true,
+		},
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) > *ImportMaxRedirects {
+				return errTooManyRedirects
+			}
+			return checkImportUrl(r.URL)
+		},
+	}
+}
+
+// Fetch the file to import. Returns the status code which should be
+// responded with on error.
+func fetchImport(ctx context.Context, rawUrl string) (*http.Response, int, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, http.StatusBadRequest, errImportUrl
+	}
+	if err = checkImportUrl(u); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	r, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, http.StatusBadRequest, errImportUrl
+	}
+	r.Header.Set("Accept", "image/*")
+
+	resp, err := newImportClient().Do(r)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, http.StatusGatewayTimeout, ctx.Err()
+		}
+		var urlErr *url.Error
+		switch {
+		case errors.Is(err, errForbiddenAddress):
+			return nil, http.StatusBadRequest, errForbiddenAddress
+		case errors.Is(err, errImportUrl):
+			return nil, http.StatusBadRequest, errImportUrl
+		case errors.As(err, &urlErr) && urlErr.Timeout():
+			return nil, http.StatusGatewayTimeout, errors.New(`remote server timeout`)
+		case errors.Is(err, errTooManyRedirects):
+			return nil, http.StatusBadGateway, errTooManyRedirects
+		}
+		return nil, http.StatusBadGateway, errors.New(`can't fetch the file`)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, http.StatusBadGateway, errors.New(`remote server responded with ` + strconv.Itoa(resp.StatusCode))
+	}
+	if resp.ContentLength > MaxFileSize {
+		resp.Body.Close()
+		return nil, http.StatusRequestEntityTooLarge, ErrFileTooLarge
+	}
+	return resp, 0, nil
+}
+
+// Import the avatar from the remote URL. The file is fetched within
+// "import-timeout" following at most "import-max-redirects" redirects and
+// only from public addresses. It is checked and stored like an upload.
+// Responds with 409 if the avatar already exists.
+func ImportFile(c web.C, w http.ResponseWriter, r *http.Request) {
+	var upload ImportUpload
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxFormFieldSize)).Decode(&upload); err != nil {
+		JsonResponseMsg(w, http.StatusBadRequest, `body should be json object with "url" field`)
+		return
+	}
+	mask, err := checkMask("mask", upload.Mask)
+	if err != nil {
+		JsonResponseMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the import creates the avatar, so nothing is fetched if it exists
+	if err = checkImportTarget(r.Context(), c.URLParams["id"]); err != nil {
+		status := http.StatusInternalServerError
+		if err == errAvatarExists {
+			status = http.StatusConflict
+		}
+		JsonResponseError(w, status, err)
+		return
+	}
+
+	resp, status, err := fetchImport(r.Context(), upload.Url)
+	if err != nil {
+		JsonResponseError(w, status, err)
+		return
+	}
+	defer resp.Body.Close()
+	stored, status, err := storeUploadedFile(r.Context(), resp.Body, uploadFilename(resp.Request.URL.Path))
+	if err != nil {
+		JsonResponseMsg(w, status, err.Error())
+		return
+	}
+	insertUploadedAvatar(c, w, r, stored, mask, true)
+	return
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+type ImportSuiteTester struct {
+	BaseSuite
+
+	mux     *web.Mux
+	remote  *httptest.Server
+	fetched int
+}
+
+// Settings for suite
+func (suite *ImportSuiteTester) SetupSuite() {
+	// INIT router with import handler
+	suite.mux = web.New()
+	suite.mux.Post("/:id/import", ImportFile)
+	// AND remote server with files, redirects and failures
+	remote := http.NewServeMux()
+	remote.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("hello"))
+	})
+	remote.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "20000000")
+		w.WriteHeader(http.StatusOK)
+	})
+	remote.HandleFunc("/fetched", func(w http.ResponseWriter, r *http.Request) {
+		suite.fetched++
+	})
+	remote.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	remote.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	remote.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	suite.remote = httptest.NewServer(remote)
+}
+
+// Stop remote server after suite
+func (suite *ImportSuiteTester) TearDownSuite() {
+	suite.remote.Close()
+}
+
+// Settings for each test
+func (suite *ImportSuiteTester) SetupTest() {
+	// INIT allowed loopback addresses of the test server
+	allowImportIP = func(ip net.IP) bool { return ip.IsLoopback() }
+	// AND avatars which don't exist
+	checkImportTarget = func(context.Context, string) error { return nil }
+}
+
+// Restore settings after each test
+func (suite *ImportSuiteTester) TearDownTest() {
+	allowImportIP = isPublicIP
+	checkImportTarget = checkForExistedImage
+}
+
+// Send import request with the given body.
+func (suite *ImportSuiteTester) importFile(body string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("POST", "/"+RandomMD5()+"/import", strings.NewReader(body))
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	return w
+}
+
+// Test validation of the imported URL
+func (suite *ImportSuiteTester) TestUrl() {
+	// WHEN I import from non-http URL
+	w := suite.importFile(`{"url": "file:///etc/passwd"}`)
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+
+	// WHEN I import from private address by default policy
+	allowImportIP = isPublicIP
+	w = suite.importFile(`{"url": "` + suite.remote.URL + `/text"}`)
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+	suite.Contains(w.Body.String(), "forbidden address")
+}
+
+// Test importing the avatar which exists
+func (suite *ImportSuiteTester) TestExistingAvatar() {
+	// GIVEN existing avatar
+	checkImportTarget = func(context.Context, string) error { return errAvatarExists }
+	suite.fetched = 0
+
+	// WHEN I import the avatar
+	w := suite.importFile(`{"url": "` + suite.remote.URL + `/fetched"}`)
+	// THEN response status code should be 409
+	suite.Equal(http.StatusConflict, w.Code)
+	// AND nothing should be fetched
+	suite.Equal(0, suite.fetched)
+}
+
+// Test failures of the remote server
+func (suite *ImportSuiteTester) TestRemoteFailures() {
+	// WHEN remote server responds with 404
+	w := suite.importFile(`{"url": "` + suite.remote.URL + `/missing"}`)
+	// THEN response status code should be 502
+	suite.Equal(http.StatusBadGateway, w.Code)
+
+	// WHEN remote server redirects endlessly
+	w = suite.importFile(`{"url": "` + suite.remote.URL + `/loop"}`)
+	// THEN response status code should be 502
+	suite.Equal(http.StatusBadGateway, w.Code)
+	suite.Contains(w.Body.String(), "too many redirects")
+
+	// WHEN remote server responds slower than import timeout
+	timeout := *ImportTimeout
+	*ImportTimeout = 50 * time.Millisecond
+	w = suite.importFile(`{"url": "` + suite.remote.URL + `/slow"}`)
+	*ImportTimeout = timeout
+	// THEN response status code should be 504
+	suite.Equal(http.StatusGatewayTimeout, w.Code)
+}
+
+// Test checking of the remote file
+func (suite *ImportSuiteTester) TestRemoteFile() {
+	// WHEN remote file is larger than the limit
+	w := suite.importFile(`{"url": "` + suite.remote.URL + `/large"}`)
+	// THEN response status code should be 413
+	suite.Equal(http.StatusRequestEntityTooLarge, w.Code)
+
+	// WHEN remote file is not an image despite its content type
+	w = suite.importFile(`{"url": "` + suite.remote.URL + `/text"}`)
+	// THEN response status code should be 415
+	suite.Equal(http.StatusUnsupportedMediaType, w.Code)
+}
+
+// Test public addresses
+func (suite *ImportSuiteTester) TestIsPublicIP() {
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fd00::1", "fe80::1", "::ffff:127.0.0.1"} {
+		suite.False(isPublicIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"8.8.8.8", "2001:4860:4860::8888"} {
+		suite.True(isPublicIP(net.ParseIP(ip)), ip)
+	}
+}
+
+// TestRunImportSuite will be run by the 'go test' command
+func TestRunImportSuite(t *testing.T) {
+	Run(t, new(ImportSuiteTester))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const DefaultInitials = "initials"
+
+// Height of the initials relative to the image size.
+const initialsScale = 0.42
+
+var initialsFont = mustParseFont(gobold.TTF)
+
+func mustParseFont(ttf []byte) *opentype.Font {
+	f, err := opentype.Parse(ttf)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Get one or two uppercase initials of the name: the first letters of the
+// first and the last words.
+func initials(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	first := []rune(words[0])[0]
+	if len(words) == 1 {
+		return strings.ToUpper(string(first))
+	}
+	last := []rune(words[len(words)-1])[0]
+	return strings.ToUpper(string([]rune{first, last}))
+}
+
+// Get text color which is readable on the background.
+func initialsForeground(bg color.NRGBA) color.NRGBA {
+	// relative luminance, ITU-R BT.601
+	if 299*int(bg.R)+587*int(bg.G)+114*int(bg.B) > 160*1000 {
+		return color.NRGBA{0x33, 0x33, 0x33, 0xff}
+	}
+	return color.NRGBA{0xff, 0xff, 0xff, 0xff}
+}
+
+// Render initials of the name on the background colored by the id.
+func renderInitials(id string, name string, size int) (image.Image, error) {
+	bg := idColor(id)
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{bg}, image.ZP, draw.Src)
+
+	face, err := opentype.NewFace(initialsFont, &opentype.FaceOptions{
+		Size:    float64(size) * initialsScale,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	text := initials(name)
+	drawer := &font.Drawer{
+		Dst:  img,
+		Src:  &image.Uniform{initialsForeground(bg)},
+		Face: face,
+	}
+	// center the text box by its advance and the capital letters height
+	advance := drawer.MeasureString(text)
+	drawer.Dot = fixed.Point26_6{
+		X: (fixed.I(size) - advance) / 2,
+		Y: (fixed.I(size) + face.Metrics().CapHeight) / 2,
+	}
+	drawer.DrawString(text)
+	return img, nil
+}
+
+// Render initials of the name as SVG document.
+func renderInitialsSVG(id string, name string, size int, shape string, radius int) []byte {
+	bg := idColor(id)
+	fg := initialsForeground(bg)
+	hex := func(c color.NRGBA) string {
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+
+	var background string
+	switch shape {
+	case ShapeCircle:
+		background = fmt.Sprintf(`<circle cx="%[1]d" cy="%[1]d" r="%[1]d" fill="%[2]s"/>`, size/2, hex(bg))
+	case ShapeRounded:
+		background = fmt.Sprintf(`<rect width="%[1]d" height="%[1]d" rx="%[2]d" fill="%[3]s"/>`, size, radius, hex(bg))
+	default:
+		background = fmt.Sprintf(`<rect width="%[1]d" height="%[1]d" fill="%[2]s"/>`, size, hex(bg))
+	}
+
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="%[1]d" viewBox="0 0 %[1]d %[1]d">`+
+		`%[2]s<text x="50%%" y="50%%" dy=".35em" text-anchor="middle" fill="%[3]s" `+
+		`font-family="Go, Helvetica, Arial, sans-serif" font-weight="bold" font-size="%[4]d">%[5]s</text></svg>`,
+		size, background, hex(fg), int(float64(size)*initialsScale), html.EscapeString(initials(name))))
+}
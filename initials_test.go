@@ -0,0 +1,99 @@
+package main
+
+import (
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+type InitialsSuiteTester struct {
+	BaseSuite
+
+	mux *web.Mux
+}
+
+// Settings for suite
+func (suite *InitialsSuiteTester) SetupSuite() {
+	// INIT test router with default file handler
+	suite.mux = web.New()
+	suite.mux.Get("/:id", GetDefaultFile)
+}
+
+// Test getting initials from names
+func (suite *InitialsSuiteTester) TestInitials() {
+	cases := map[string]string{
+		"john":                "J",
+		"John Smith":          "JS",
+		"john ronald r tolk":  "JT",
+		"  Анна   Каренина  ": "АК",
+		"o'neil, shaq":        "OS",
+		"":                    "",
+		"-- !!":               "",
+	}
+	for name, expected := range cases {
+		suite.Equal(expected, initials(name), name)
+	}
+}
+
+// Test rendering initials image
+func (suite *InitialsSuiteTester) TestRenderInitials() {
+	// WHEN I render initials of size 100
+	img, err := renderInitials(RandomMD5(), "John Smith", 100)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// THEN image should have requested size
+	suite.Equal(image.Rect(0, 0, 100, 100), img.Bounds())
+	// AND some pixels should differ from the background
+	text := 0
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			if img.At(x, y) != img.At(0, 0) {
+				text++
+			}
+		}
+	}
+	suite.True(text > 0)
+}
+
+// Test serving initials as SVG
+func (suite *InitialsSuiteTester) TestDefaultFileSVG() {
+	// WHEN I request initials in SVG format
+	r, err := http.NewRequest("GET", "/"+RandomMD5()+"?d=initials&name=%3Cb%3E+smith&format=svg&shape=circle", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	// THEN response status code should be 200
+	suite.Equal(http.StatusOK, w.Code)
+	// AND response should be SVG document with escaped initials
+	suite.Equal("image/svg+xml", w.Header().Get("Content-Type"))
+	suite.True(strings.HasPrefix(w.Body.String(), "<svg"))
+	suite.Contains(w.Body.String(), ">BS</text>")
+	suite.Contains(w.Body.String(), "<circle")
+}
+
+// Test serving initials with invalid parameters
+func (suite *InitialsSuiteTester) TestDefaultFileInvalidParams() {
+	for _, query := range []string{"d=initials", "d=initials&name=--", "d=initials&name=a&format=jpg", "d=identicon&format=svg"} {
+		// WHEN I request initials with invalid query
+		r, err := http.NewRequest("GET", "/"+RandomMD5()+"?"+query, nil)
+		if err != nil {
+			suite.T().Error(err.Error())
+		}
+		w := httptest.NewRecorder()
+		suite.mux.ServeHTTP(w, r)
+		// THEN response status code should be 400
+		suite.Equal(http.StatusBadRequest, w.Code, query)
+	}
+}
+
+// TestRunInitialsSuite will be run by the 'go test' command
+func TestRunInitialsSuite(t *testing.T) {
+	Run(t, new(InitialsSuiteTester))
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Number of avatars in the page if "limit" is not set.
+	defaultListLimit = 50
+	// Max number of avatars in the page.
+	maxListLimit = 500
+)
+
+// Sorting options of the listing mapped to the stored fields. Avatars stored
+// before the metadata was added have no timestamps and size, they are sorted
+// as the smallest values.
+var listSortFields = map[string]string{
+	"id":      "_id",
+	"created": "created",
+	"updated": "updated",
+	"size":    "original.size",
+}
+
+// Moderation states of the listing filter. Avatars which were not moderated
+// are matched by "none".
+var listModerationStates = []string{"pending", "approved", "rejected", "none"}
+
+// Filters, sorting and position of the avatars listing page.
+type AvatarFilter struct {
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	// Bounds of the original file size in bytes, 0 is unbounded.
+	MinSize int64
+	MaxSize int64
+	Format  string
+	// Moderation state, "none" for avatars without it, empty is any.
+	Moderation string
+	// Stored field to sort by and the direction.
+	Sort string
+	Desc bool
+	// Max number of avatars in the page.
+	Limit int
+	// Position after which the page starts, nil for the first page.
+	Cursor *ListCursor
+}
+
+// ListCursor points to the last avatar of the page by its sort value and id.
+// The sorting is kept to reject the cursor used with another one.
+type ListCursor struct {
+	Sort  string      `bson:"s"`
+	Desc  bool        `bson:"d,omitempty"`
+	Value interface{} `bson:"v"`
+	Id    string      `bson:"id"`
+}
+
+// Page of the avatars listing. Next cursor is empty on the last page.
+type ListResult struct {
+	Avatars    []*Avatar `json:"avatars"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// Encode the cursor into the opaque URL-safe string. BSON keeps the type of
+// the sort value: time, size or id.
+func (cur *ListCursor) String() string {
+	data, err := bson.Marshal(cur)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseListCursor(s string) (*ListCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	cur := &ListCursor{}
+	if err = bson.Unmarshal(data, cur); err != nil {
+		return nil, err
+	}
+	if !cur.valid() {
+		return nil, errors.New("cursor value doesn't match the sort field")
+	}
+	return cur, nil
+}
+
+// Check whether the type of the sort value is the one of the sort field, so
+// the query doesn't compare the field with a value of another type. Only ids
+// can't be missing.
+func (cur *ListCursor) valid() bool {
+	switch cur.Value.(type) {
+	case nil:
+		return cur.Sort != "_id"
+	case string:
+		return cur.Sort == "_id" && cur.Value == cur.Id
+	case time.Time:
+		return cur.Sort == "created" || cur.Sort == "updated"
+	case int64:
+		return cur.Sort == "original.size"
+	}
+	return false
+}
+
+// Get the cursor pointing to the avatar in the sorting of the filter.
+// Missing values of the old avatars are nil.
+func listCursorOf(avatar *Avatar, f *AvatarFilter) *ListCursor {
+	cur := &ListCursor{Sort: f.Sort, Desc: f.Desc, Id: avatar.Id}
+	switch f.Sort {
+	case "_id":
+		cur.Value = avatar.Id
+	case "created":
+		if !avatar.Created.IsZero() {
+			cur.Value = avatar.Created
+		}
+	case "updated":
+		if !avatar.Updated.IsZero() {
+			cur.Value = avatar.Updated
+		}
+	case "original.size":
+		if avatar.Original != nil {
+			cur.Value = avatar.Original.Size
+		}
+	}
+	return cur
+}
+
+// Build the filter from query parameters: "created_after", "created_before",
+// "updated_after", "updated_before" (RFC 3339), "min_size", "max_size",
+// "format", "moderation" ("pending", "approved", "rejected" or "none"),
+// "sort" ("id", "created", "updated" or "size", prefixed by "-" for the
+// descending order), "limit" and "cursor".
+func parseAvatarFilter(query url.Values) (*AvatarFilter, error) {
+	filter := &AvatarFilter{Sort: "_id", Limit: defaultListLimit, Format: query.Get("format")}
+
+	times := map[string]*time.Time{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+		"updated_after":  &filter.UpdatedAfter,
+		"updated_before": &filter.UpdatedBefore,
+	}
+	for name, value := range times {
+		if s := query.Get(name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, errors.New(`parameter "` + name + `" should be RFC 3339 time`)
+			}
+			*value = t
+		}
+	}
+
+	sizes := map[string]*int64{
+		"min_size": &filter.MinSize,
+		"max_size": &filter.MaxSize,
+	}
+	for name, value := range sizes {
+		if s := query.Get(name); s != "" {
+			size, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || size < 0 {
+				return nil, errors.New(`parameter "` + name + `" should be non-negative integer`)
+			}
+			*value = size
+		}
+	}
+
+	if s := query.Get("moderation"); s != "" {
+		if !contains(listModerationStates, s) {
+			return nil, errors.New(`parameter "moderation" should be "pending", "approved", "rejected" or "none"`)
+		}
+		filter.Moderation = s
+	}
+
+	if s := query.Get("sort"); s != "" {
+		field, ok := listSortFields[strings.TrimPrefix(s, "-")]
+		if !ok {
+			return nil, errors.New(`parameter "sort" should be "id", "created", "updated" or "size"`)
+		}
+		filter.Sort, filter.Desc = field, strings.HasPrefix(s, "-")
+	}
+
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return nil, errors.New(`parameter "limit" should be from 1 to ` + strconv.Itoa(maxListLimit))
+		}
+		filter.Limit = limit
+	}
+
+	if s := query.Get("cursor"); s != "" {
+		cur, err := parseListCursor(s)
+		if err != nil {
+			return nil, errors.New(`parameter "cursor" is invalid`)
+		}
+		if cur.Sort != filter.Sort || cur.Desc != filter.Desc {
+			return nil, errors.New(`parameter "cursor" belongs to another "sort"`)
+		}
+		filter.Cursor = cur
+	}
+	return filter, nil
+}
+
+// Build MongoDB query of the filter. The page continues after the cursor in
+// the order of the sort field and id, avatars without the sort field go
+// first in the ascending order and last in the descending one.
+func (f *AvatarFilter) query() bson.M {
+	q := bson.M{}
+	// set the bounds of the field skipping unset ones
+	rangeOf := func(field string, bounds bson.M) {
+		for op, bound := range bounds {
+			if bound == nil {
+				delete(bounds, op)
+			}
+		}
+		if len(bounds) > 0 {
+			q[field] = bounds
+		}
+	}
+	timeOrNil := func(t time.Time) interface{} {
+		if t.IsZero() {
+			return nil
+		}
+		return t
+	}
+	sizeOrNil := func(size int64) interface{} {
+		if size == 0 {
+			return nil
+		}
+		return size
+	}
+	rangeOf("created", bson.M{"$gte": timeOrNil(f.CreatedAfter), "$lt": timeOrNil(f.CreatedBefore)})
+	rangeOf("updated", bson.M{"$gte": timeOrNil(f.UpdatedAfter), "$lt": timeOrNil(f.UpdatedBefore)})
+	rangeOf("original.size", bson.M{"$gte": sizeOrNil(f.MinSize), "$lte": sizeOrNil(f.MaxSize)})
+	if f.Format != "" {
+		q["format"] = f.Format
+	}
+	if f.Moderation == "none" {
+		q["moderation"] = nil
+	} else if f.Moderation != "" {
+		q["moderation"] = f.Moderation
+	}
+
+	if f.Cursor == nil {
+		return q
+	}
+	op := "$gt"
+	if f.Desc {
+		op = "$lt"
+	}
+	after := bson.M{"_id": bson.M{op: f.Cursor.Id}}
+	switch {
+	case f.Sort == "_id":
+		return bson.M{"$and": []bson.M{q, after}}
+	case f.Cursor.Value == nil && f.Desc:
+		after[f.Sort] = nil
+		return bson.M{"$and": []bson.M{q, after}}
+	case f.Cursor.Value == nil:
+		after[f.Sort] = nil
+		return bson.M{"$and": []bson.M{q, {"$or": []bson.M{after, {f.Sort: bson.M{"$ne": nil}}}}}}
+	}
+	after[f.Sort] = f.Cursor.Value
+	next := []bson.M{{f.Sort: bson.M{op: f.Cursor.Value}}, after}
+	if f.Desc {
+		next = append(next, bson.M{f.Sort: nil})
+	}
+	return bson.M{"$and": []bson.M{q, {"$or": next}}}
+}
+
+// Get the sort keys of the filter for MongoDB.
+func (f *AvatarFilter) sortKeys() []string {
+	if f.Sort == "_id" {
+		if f.Desc {
+			return []string{"-_id"}
+		}
+		return []string{"_id"}
+	}
+	if f.Desc {
+		return []string{"-" + f.Sort, "-_id"}
+	}
+	return []string{f.Sort, "_id"}
+}
+
+// List stored avatars page by page. Admins only.
+func ListFiles(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAvatarFilter(r.URL.Query())
+	if err != nil {
+		JsonResponseMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	avatars, err := ListAvatars(r.Context(), filter)
+	if err != nil {
+		JsonResponseError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result := ListResult{Avatars: avatars}
+	if len(avatars) > filter.Limit {
+		result.Avatars = avatars[:filter.Limit]
+		result.NextCursor = listCursorOf(result.Avatars[filter.Limit-1], filter).String()
+	}
+	if result.Avatars == nil {
+		result.Avatars = []*Avatar{}
+	}
+	JsonResponse(w, http.StatusOK, result)
+	return
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ListingSuiteTester struct {
+	BaseSuite
+}
+
+// Test parsing of the listing parameters
+func (suite *ListingSuiteTester) TestParseFilter() {
+	// WHEN I set no parameters
+	filter, err := parseAvatarFilter(url.Values{})
+	// THEN the first page should be sorted by id
+	suite.Nil(err)
+	suite.Equal("_id", filter.Sort)
+	suite.Equal(defaultListLimit, filter.Limit)
+	suite.Equal(bson.M{}, filter.query())
+
+	// WHEN I set filters and descending sorting by size
+	filter, err = parseAvatarFilter(url.Values{
+		"created_after": {"2024-01-02T03:04:05Z"},
+		"max_size":      {"1024"},
+		"format":        {"png"},
+		"moderation":    {"pending"},
+		"sort":          {"-size"},
+		"limit":         {"10"},
+	})
+	// THEN they should be set
+	suite.Nil(err)
+	suite.Equal("original.size", filter.Sort)
+	suite.True(filter.Desc)
+	suite.Equal(10, filter.Limit)
+	// AND query should contain the bounds which are set only
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	suite.Equal(bson.M{
+		"created":       bson.M{"$gte": created},
+		"original.size": bson.M{"$lte": int64(1024)},
+		"format":        "png",
+		"moderation":    "pending",
+	}, filter.query())
+	suite.Equal([]string{"-original.size", "-_id"}, filter.sortKeys())
+
+	// WHEN I filter avatars which were not moderated
+	filter, err = parseAvatarFilter(url.Values{"moderation": {"none"}})
+	// THEN query should match avatars without the state
+	suite.Nil(err)
+	suite.Equal(bson.M{"moderation": nil}, filter.query())
+
+	// WHEN I set invalid parameters
+	for name, value := range map[string]string{
+		"created_before": "yesterday",
+		"min_size":       "-1",
+		"moderation":     "banned",
+		"sort":           "name",
+		"limit":          "1000",
+		"cursor":         "%%%",
+	} {
+		_, err = parseAvatarFilter(url.Values{name: {value}})
+		// THEN error should be raised
+		suite.Error(err, name)
+	}
+}
+
+// Test continuing the page after the cursor
+func (suite *ListingSuiteTester) TestCursor() {
+	// GIVEN the last avatar of the page
+	updated := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	avatar := &Avatar{Id: RandomMD5(), Updated: updated}
+
+	// WHEN I encode its cursor and parse it back
+	filter, err := parseAvatarFilter(url.Values{
+		"sort":   {"updated"},
+		"cursor": {listCursorOf(avatar, &AvatarFilter{Sort: "updated"}).String()},
+	})
+	// THEN the type of the sort value should be kept
+	suite.Nil(err)
+	suite.Equal(avatar.Id, filter.Cursor.Id)
+	suite.True(updated.Equal(filter.Cursor.Value.(time.Time)))
+	// AND the page should continue after the avatar
+	suite.Equal(bson.M{"$and": []bson.M{{}, {"$or": []bson.M{
+		{"updated": bson.M{"$gt": filter.Cursor.Value}},
+		{"updated": filter.Cursor.Value, "_id": bson.M{"$gt": avatar.Id}},
+	}}}}, filter.query())
+
+	// WHEN the avatar has no sort value
+	filter.Cursor = listCursorOf(&Avatar{Id: avatar.Id}, filter)
+	// THEN the page should continue with the other avatars without the value and then with all the others
+	suite.Equal(bson.M{"$and": []bson.M{{}, {"$or": []bson.M{
+		{"updated": nil, "_id": bson.M{"$gt": avatar.Id}},
+		{"updated": bson.M{"$ne": nil}},
+	}}}}, filter.query())
+
+	// WHEN I use the cursor with another sorting
+	for _, sort := range []string{"-updated", "created"} {
+		_, err = parseAvatarFilter(url.Values{
+			"sort":   {sort},
+			"cursor": {listCursorOf(avatar, &AvatarFilter{Sort: "updated"}).String()},
+		})
+		// THEN the cursor should be rejected
+		suite.NotNil(err, sort)
+	}
+
+	// WHEN the sort value of the cursor has another type than the sort field
+	for sort, value := range map[string]interface{}{
+		"id":      int64(1),
+		"updated": "2024-01-02T03:04:05Z",
+		"created": int64(1),
+		"size":    updated,
+	} {
+		cur := &ListCursor{Sort: listSortFields[sort], Value: value, Id: avatar.Id}
+		_, err = parseAvatarFilter(url.Values{"sort": {sort}, "cursor": {cur.String()}})
+		// THEN the cursor should be rejected
+		suite.EqualError(err, `parameter "cursor" is invalid`, sort)
+	}
+}
+
+// TestRunListingSuite will be run by the 'go test' command
+func TestRunListingSuite(t *testing.T) {
+	Run(t, new(ListingSuiteTester))
+}
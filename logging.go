@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/drone/config"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/mutil"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var LogLevel = config.String("log-level", "info")
+
+const (
+	RequestIdHeader = "X-Request-ID"
+	// Key of the request id in the request environment.
+	RequestIdEnvKey = "requestId"
+	// Incoming request ids longer than this are replaced.
+	maxRequestIdLength = 128
+	// Logged status of the requests canceled by the client, as nginx does.
+	statusClientClosedRequest = 499
+)
+
+// logger writes JSON lines to stdout.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// Set the level of the logger. Should be called after the configuration is
+// parsed.
+func initLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*LogLevel)); err != nil {
+		return err
+	}
+	logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+	return nil
+}
+
+var requestIdPattern = regexp.MustCompile(`^[\x21-\x7e]+$`)
+
+// Generate random request id.
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestId takes the request id of "X-Request-ID" header or generates a new
+// one if it is missing or malformed. The id is returned in the response
+// header as well.
+func RequestId(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if len(id) > maxRequestIdLength || !requestIdPattern.MatchString(id) {
+			id = newRequestId()
+		}
+
+		if c.Env == nil {
+			c.Env = make(map[interface{}]interface{})
+		}
+		c.Env[RequestIdEnvKey] = id
+		w.Header().Set(RequestIdHeader, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Get the request id set by RequestId middleware.
+func GetRequestId(c web.C) string {
+	id, _ := c.Env[RequestIdEnvKey].(string)
+	return id
+}
+
+// logResponseWriter keeps the error message of the response for logging.
+type logResponseWriter struct {
+	mutil.WriterProxy
+	cause string
+}
+
+// Remember the cause of the error response if the writer is logged.
+func setErrorCause(w http.ResponseWriter, cause string) {
+	if lw, ok := w.(*logResponseWriter); ok {
+		lw.cause = cause
+	}
+}
+
+var avatarIdPattern = regexp.MustCompile(`[a-fA-F0-9]{32}`)
+
+// Logger writes a JSON line for every request with the request id, route,
+// avatar id, status, latency and error cause. Should be used after
+// RequestId middleware.
+func Logger(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &logResponseWriter{WriterProxy: mutil.WrapWriter(w)}
+		h.ServeHTTP(lw, r)
+
+		status := lw.Status()
+		if status == 0 {
+			status = http.StatusOK
+			// nothing is written to the clients which have gone away
+			if r.Context().Err() == context.Canceled {
+				status = statusClientClosedRequest
+			}
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if status >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("request_id", GetRequestId(*c)),
+			slog.String("method", r.Method),
+			slog.String("route", routeLabel(r.URL.Path)),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", lw.BytesWritten()),
+			slog.String("remote_ip", clientIP(r)),
+		}
+		if id := avatarIdPattern.FindString(r.URL.Path); id != "" {
+			attrs = append(attrs, slog.String("avatar_id", id))
+		}
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", span.TraceID().String()))
+		}
+		if lw.cause != "" {
+			attrs = append(attrs, slog.String("error", lw.cause))
+		}
+		logger.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+type LoggingSuiteTester struct {
+	BaseSuite
+
+	mux    *web.Mux
+	output *bytes.Buffer
+	logger *slog.Logger
+}
+
+// Settings for suite
+func (suite *LoggingSuiteTester) SetupSuite() {
+	// INIT router with "RequestId" and "Logger" middlewares
+	suite.mux = web.New()
+	suite.mux.Use(RequestId)
+	suite.mux.Use(Logger)
+	suite.mux.Get(BaseApiUrl+"file/:id", func(w http.ResponseWriter, r *http.Request) {
+		JsonResponseMsg(w, http.StatusNotFound, `not found`)
+	})
+	suite.logger = logger
+}
+
+// Settings for each test
+func (suite *LoggingSuiteTester) SetupTest() {
+	// INIT write logs into buffer
+	suite.output = bytes.NewBuffer(nil)
+	logger = slog.New(slog.NewJSONHandler(suite.output, nil))
+}
+
+// Restore the logger after suite
+func (suite *LoggingSuiteTester) TearDownSuite() {
+	logger = suite.logger
+}
+
+// Send request with the request id and decode the log line.
+func (suite *LoggingSuiteTester) request(path string, requestId string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	r, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	if requestId != "" {
+		r.Header.Set(RequestIdHeader, requestId)
+	}
+	w := httptest.NewRecorder()
+	suite.output.Reset()
+	suite.mux.ServeHTTP(w, r)
+
+	line := map[string]interface{}{}
+	if err := json.Unmarshal(suite.output.Bytes(), &line); err != nil {
+		suite.T().Error(err.Error())
+	}
+	return w, line
+}
+
+// Test logging of the request with incoming request id
+func (suite *LoggingSuiteTester) TestIncomingRequestId() {
+	// GIVEN avatar id
+	id := "d41d8cd98f00b204e9800998ecf8427e"
+	// WHEN I send request with request id
+	w, line := suite.request(BaseApiUrl+"file/"+id, "trace-42")
+	// THEN request id should be returned
+	suite.Equal("trace-42", w.Header().Get(RequestIdHeader))
+	// AND log line should describe the request
+	suite.Equal("trace-42", line["request_id"])
+	suite.Equal(BaseApiUrl+"file/:id", line["route"])
+	suite.Equal(id, line["avatar_id"])
+	suite.Equal(float64(http.StatusNotFound), line["status"])
+	suite.Equal("not found", line["error"])
+	suite.Equal("WARN", line["level"])
+	suite.Contains(line, "latency_ms")
+}
+
+// Test generating of the request id
+func (suite *LoggingSuiteTester) TestGeneratedRequestId() {
+	// WHEN I send request without request id
+	w, line := suite.request("/unknown", "")
+	// THEN new request id should be generated and logged
+	requestId := w.Header().Get(RequestIdHeader)
+	suite.Len(requestId, 32)
+	suite.Equal(requestId, line["request_id"])
+	suite.Equal("other", line["route"])
+	suite.NotContains(line, "avatar_id")
+
+	// WHEN I send request with malformed request id
+	w, _ = suite.request("/unknown", "spaces are not allowed")
+	// THEN it should be replaced
+	suite.Len(w.Header().Get(RequestIdHeader), 32)
+}
+
+// TestRunLoggingSuite will be run by the 'go test' command
+func TestRunLoggingSuite(t *testing.T) {
+	Run(t, new(LoggingSuiteTester))
+}
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/drone/config"
 	"github.com/zenazn/goji/web"
-	"github.com/zenazn/goji/web/middleware"
 )
 
 const (
 	BaseUrl    = `/`
 	ApiUrl     = `api/v1/`
 	BaseApiUrl = BaseUrl + ApiUrl
+
+	GravatarUrl = BaseUrl + `avatar/`
+	MetricsUrl  = BaseUrl + `metrics`
+	FilesUrl    = BaseApiUrl + `files`
+	BatchGetUrl = BaseApiUrl + `files:batchGet`
 )
 
 var (
@@ -22,29 +31,103 @@ func main() {
 	config.SetPrefix("AV_")
 	config.Parse("")
 
+	if err := initLogging(); err != nil {
+		panic(err)
+	}
+	if err := initAuth(); err != nil {
+		panic(err)
+	}
+	if !auth.enabled() {
+		logger.Warn("authentication is disabled")
+	}
+	if err := initCors(); err != nil {
+		panic(err)
+	}
+	if err := initRateLimit(); err != nil {
+		panic(err)
+	}
+	tlsConfig, err := initTLS()
+	if err != nil {
+		panic(err)
+	}
+	shutdownTracing, err := initTracing()
+	if err != nil {
+		panic(err)
+	}
+
 	mux := web.New()
+	mux.Use(RequestId)
+	mux.Use(Tracing)
+	mux.Use(Metrics)
 	mux.Use(SetHeaders)
-	mux.Use(middleware.Logger)
+	mux.Use(Logger)
+	mux.Use(Cors)
 	mux.Use(Options)
+	mux.Use(RateLimit)
+	mux.Use(RequireClientCert)
+	mux.Use(Auth)
+	mux.Use(RateLimitPrincipal)
+	mux.Use(Timeout)
 
 	// NOTE: "RouterWithId" router needs for using URL parameters in CheckId middleware.
 	// Goji can't bind URL parameters until after the middleware stack runs.
 	// https://github.com/zenazn/goji/issues/32#issuecomment-46124240
 	RouterWithId := web.New()
 	RouterWithId.Use(CheckId)
+	RouterWithId.Use(Authorize)
 	RouterWithId.Post(BaseApiUrl+"file/:id", UploadFile)
 	RouterWithId.Put(BaseApiUrl+"file/:id", UpdateFile)
 	RouterWithId.Patch(BaseApiUrl+"file/:id", ChangeMask)
 	RouterWithId.Delete(BaseApiUrl+"file/:id", DeleteFile)
 	RouterWithId.Get(BaseApiUrl+"file/:id", GetResizedFile)
 	RouterWithId.Get(BaseApiUrl+"file/:id/raw", GetOriginalFile)
+	RouterWithId.Get(BaseApiUrl+"file/:id/meta", GetFileMeta)
+	RouterWithId.Post(BaseApiUrl+"file/:id/import", ImportFile)
+
+	mux.Post(BatchGetUrl, BatchGetFiles)
+
+	AdminRouter := web.New()
+	AdminRouter.Use(RequireAdmin)
+	AdminRouter.Get(FilesUrl, ListFiles)
 
+	mux.Handle(FilesUrl, AdminRouter)
 	mux.Handle(BaseApiUrl+"file/:id", RouterWithId)
 	mux.Handle(BaseApiUrl+"file/:id/*", RouterWithId)
 
+	// Gravatar compatible routes
+	GravatarRouter := web.New()
+	GravatarRouter.Use(CheckId)
+	GravatarRouter.Get(GravatarUrl+":id", GetGravatar)
+
+	mux.Handle(GravatarUrl+":id", GravatarRouter)
+
 	http.Handle(BaseApiUrl, mux)
+	http.Handle(GravatarUrl, mux)
+	http.HandleFunc(HealthUrl, Healthz)
+	http.HandleFunc(ReadinessUrl, Readyz)
 
 	http.Handle(BaseUrl, http.FileServer(http.Dir("app")))
 
-	panic(http.ListenAndServe(*Listen, nil))
+	go watchIndexes()
+	if err = serveMetrics(); err != nil {
+		panic(err)
+	}
+	l, err := net.Listen("tcp", *Listen)
+	if err != nil {
+		panic(err)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	server := newServer(nil)
+	server.TLSConfig = tlsConfig
+	if err = runServer(server, l, stop); err != nil {
+		logger.Error("shutdown failed", "error", err)
+	}
+	closeSession()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *ShutdownTimeout)
+	defer cancel()
+	if err = shutdownTracing(ctx); err != nil {
+		logger.Error("flushing spans failed", "error", err)
+	}
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/drone/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/mutil"
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	MetricsListen          = config.String("metrics-http", "127.0.0.1:9100")
+	MetricsStorageInterval = config.Duration("metrics-storage-interval", time.Minute)
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "avatars",
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "avatars",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	uploadSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "avatars",
+		Name:      "upload_size_bytes",
+		Help:      "Size of uploaded files.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	})
+
+	processingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "avatars",
+		Name:      "image_processing_duration_seconds",
+		Help:      "Duration of image processing steps: decode, crop, resize, shape and encode.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"step"})
+
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "avatars",
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Latency of MongoDB and GridFS operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	storageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "avatars",
+		Name:      "storage_operation_errors_total",
+		Help:      "Number of failed MongoDB and GridFS operations, not found results are not counted.",
+	}, []string{"operation"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "avatars",
+		Name:      "cache_requests_total",
+		Help:      `Number of image requests by result: "hit" is answered with 304, "miss" with the content.`,
+	}, []string{"result"})
+
+	storedAvatars = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "avatars",
+		Name:      "stored_avatars",
+		Help:      "Number of stored avatars.",
+	})
+
+	storedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "avatars",
+		Name:      "stored_bytes",
+		Help:      "Size of all files stored in GridFS.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		requestDuration,
+		uploadSize,
+		processingDuration,
+		storageDuration,
+		storageErrors,
+		cacheRequests,
+		storedAvatars,
+		storedBytes,
+	)
+}
+
+// Serve metrics on the separate "metrics-http" listener, so they are not
+// exposed with the public API. Metrics are not served if it is empty.
+// Storage gauges are not updated if "metrics-storage-interval" is not
+// positive.
+func serveMetrics() error {
+	if *MetricsListen == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", *MetricsListen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsUrl, promhttp.Handler())
+	server := newServer(mux)
+	server.Addr = *MetricsListen
+
+	if *MetricsStorageInterval > 0 {
+		go watchStorageStats(*MetricsStorageInterval)
+	} else {
+		// storage stats are disabled, they are unknown rather than zero
+		storedAvatars.Set(math.NaN())
+		storedBytes.Set(math.NaN())
+	}
+	go func() {
+		if err := server.Serve(l); err != nil {
+			logger.Error("metrics server failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Update storage gauges every interval, which should be positive. Counting all avatars and summing
+// file sizes is expensive, so it is not done on every scrape.
+func watchStorageStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		updateStorageStats()
+		<-ticker.C
+	}
+}
+
+// Set storage gauges, NaN if the storage is unavailable.
+func updateStorageStats() {
+	ctx, cancel := context.WithTimeout(context.Background(), *ReadinessTimeout)
+	defer cancel()
+	count, err := CountAvatars(ctx)
+	if err != nil {
+		storedAvatars.Set(math.NaN())
+	} else {
+		storedAvatars.Set(float64(count))
+	}
+	size, err := StoredBytes(ctx)
+	if err != nil {
+		storedBytes.Set(math.NaN())
+	} else {
+		storedBytes.Set(float64(size))
+	}
+}
+
+// Known routes, everything else is counted as "other" to keep the number
+// of label values small.
+var metricsRoutes = []string{
+	BaseApiUrl + "file/:id",
+	BaseApiUrl + "file/:id/raw",
+	BaseApiUrl + "file/:id/meta",
+	BaseApiUrl + "file/:id/import",
+	FilesUrl,
+	BatchGetUrl,
+	GravatarUrl + ":id",
+}
+
+var idPattern = regexp.MustCompile(`/[^/]*[a-fA-F0-9]{32}[^/]*`)
+
+// Get the route of the path with ids replaced by ":id".
+func routeLabel(path string) string {
+	route := idPattern.ReplaceAllString(path, "/:id")
+	if contains(metricsRoutes, route) {
+		return route
+	}
+	return "other"
+}
+
+// Metrics counts requests and observes their latency.
+func Metrics(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := mutil.WrapWriter(w)
+		h.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := prometheus.Labels{
+			"route":  routeLabel(r.URL.Path),
+			"method": r.Method,
+			"status": strconv.Itoa(status),
+		}
+		requestsTotal.With(labels).Inc()
+		requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Observe the duration of image processing step since start.
+func observeProcessing(step string, start time.Time) {
+	processingDuration.WithLabelValues(step).Observe(time.Since(start).Seconds())
+}
+
+// Observe the duration of storage operation since start and count its error.
+// Should be deferred with the pointer to the returned error. Canceled
+// requests are not counted as errors.
+func observeStorage(operation string, start time.Time, err *error) {
+	storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if *err != nil && *err != mgo.ErrNotFound && *err != context.Canceled {
+		storageErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// Count the result of conditional image request.
+func observeCache(notModified bool) {
+	if notModified {
+		cacheRequests.WithLabelValues("hit").Inc()
+	} else {
+		cacheRequests.WithLabelValues("miss").Inc()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zenazn/goji/web"
+)
+
+type MetricsSuiteTester struct {
+	BaseSuite
+}
+
+// Test route labels of the paths
+func (suite *MetricsSuiteTester) TestRouteLabel() {
+	id := "d41d8cd98f00b204e9800998ecf8427e"
+	// WHEN I get routes of the known paths
+	// THEN ids should be replaced
+	suite.Equal(BaseApiUrl+"file/:id", routeLabel(BaseApiUrl+"file/"+id))
+	suite.Equal(BaseApiUrl+"file/:id/raw", routeLabel(BaseApiUrl+"file/"+id+"/raw"))
+	suite.Equal(GravatarUrl+":id", routeLabel(GravatarUrl+id+".png"))
+
+	// WHEN I get routes of the unknown paths
+	// THEN they should be counted together
+	suite.Equal("other", routeLabel("/index.html"))
+	suite.Equal("other", routeLabel(BaseApiUrl+"file/"+id+"/unknown"))
+}
+
+// Test counting of requests by status
+func (suite *MetricsSuiteTester) TestMetrics() {
+	// GIVEN router with "Metrics" middleware
+	id := "d41d8cd98f00b204e9800998ecf8427e"
+	mux := web.New()
+	mux.Use(Metrics)
+	mux.Get(BaseApiUrl+"file/:id", func(c web.C, w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("missing") != "" {
+			JsonResponseMsg(w, http.StatusNotFound, `not found`)
+		}
+	})
+	route := BaseApiUrl + "file/:id"
+	ok := requestsTotal.WithLabelValues(route, "GET", "200")
+	notFound := requestsTotal.WithLabelValues(route, "GET", "404")
+	okBefore, notFoundBefore := testutil.ToFloat64(ok), testutil.ToFloat64(notFound)
+
+	// WHEN I send request which writes nothing and request of missing file
+	for _, query := range []string{"", "?missing=1"} {
+		r, err := http.NewRequest("GET", BaseApiUrl+"file/"+id+query, nil)
+		if err != nil {
+			suite.T().Error(err.Error())
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// THEN each request should be counted with its status
+	suite.Equal(okBefore+1, testutil.ToFloat64(ok))
+	suite.Equal(notFoundBefore+1, testutil.ToFloat64(notFound))
+}
+
+// Test serving metrics without storage stats
+func (suite *MetricsSuiteTester) TestStorageStatsDisabled() {
+	// GIVEN zero interval of storage stats
+	defer func(listen string, interval time.Duration) {
+		*MetricsListen, *MetricsStorageInterval = listen, interval
+	}(*MetricsListen, *MetricsStorageInterval)
+	*MetricsListen, *MetricsStorageInterval = "127.0.0.1:0", 0
+
+	// WHEN I serve metrics
+	err := serveMetrics()
+	// THEN storage stats should be unknown
+	suite.Nil(err)
+	suite.True(math.IsNaN(testutil.ToFloat64(storedAvatars)))
+}
+
+// TestRunMetricsSuite will be run by the 'go test' command
+func TestRunMetricsSuite(t *testing.T) {
+	Run(t, new(MetricsSuiteTester))
+}
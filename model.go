@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -10,4 +12,52 @@ type Avatar struct {
 	UrlThumb  string        `bson:"url_thumb" json:"url_thumb"`
 	Origin    bson.ObjectId `bson:"origin" json:"-"`
 	Thumb     bson.ObjectId `bson:"thumb" json:"-"`
+	// Name of the uploaded file.
+	Filename string `bson:"filename,omitempty" json:"filename,omitempty"`
+	// Format of the image as reported by image.Decode: "png", "jpeg", "gif" or "bmp".
+	Format string `bson:"format,omitempty" json:"format,omitempty"`
+	// Mask the thumbnail is cut by: [x0, y0, x1, y1]. Empty if the original
+	// image is used as the thumbnail.
+	Mask      []int      `bson:"mask,omitempty" json:"mask,omitempty"`
+	Original  *ImageMeta `bson:"original,omitempty" json:"original,omitempty"`
+	Thumbnail *ImageMeta `bson:"thumbnail,omitempty" json:"thumbnail,omitempty"`
+	// State of the moderation: "pending", "approved" or "rejected". It is set
+	// by the moderation tooling, empty if the avatar was not moderated.
+	Moderation string    `bson:"moderation,omitempty" json:"moderation,omitempty"`
+	Created    time.Time `bson:"created,omitempty" json:"created"`
+	Updated    time.Time `bson:"updated,omitempty" json:"updated"`
+}
+
+// Result of the bulk lookup: avatars which exist in the order of the
+// requested ids and the ids which have no avatar.
+type BatchGetResult struct {
+	Avatars []*Avatar `json:"avatars"`
+	Missing []string  `json:"missing"`
+}
+
+// Dimensions, size and hashes of the stored image.
+type ImageMeta struct {
+	Width  int    `bson:"width" json:"width"`
+	Height int    `bson:"height" json:"height"`
+	Size   int64  `bson:"size" json:"size"`
+	MD5    string `bson:"md5" json:"md5"`
+	SHA256 string `bson:"sha256,omitempty" json:"sha256,omitempty"`
+}
+
+// Set URLs of the original and thumbnail images. URLs are versioned by the
+// file ids, so they change every time the image is changed.
+func (a *Avatar) setUrls() {
+	url := ApiUrl + "file/" + a.Id
+	a.UrlOrigin = url + "/raw?" + VersionParam + "=" + a.Origin.Hex()
+	a.UrlThumb = url + "?" + VersionParam + "=" + a.Thumb.Hex()
+}
+
+// Metadata of the image file stored in GridFS.
+type ImageInfo struct {
+	Id         bson.ObjectId
+	Name       string
+	MD5        string
+	SHA256     string
+	Size       int64
+	UploadDate time.Time
 }
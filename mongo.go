@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"image"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/drone/config"
 	"golang.org/x/image/bmp"
@@ -16,59 +21,306 @@ import (
 )
 
 var (
-	mgoSession      *mgo.Session
-	mongoUrl        = config.String("mongo-url", "mongodb://localhost/avatars")
-	GridFsPrefix    = config.String("mongo-gridfs-prefix", "avatars")
-	MongoDatabase   = config.String("mongo-database-name", "")
-	MongoCollection = config.String("mongo-collection-name", "avatars")
+	mongoUrl             = config.String("mongo-url", "mongodb://localhost/avatars")
+	GridFsPrefix         = config.String("mongo-gridfs-prefix", "avatars")
+	MongoDatabase        = config.String("mongo-database-name", "")
+	MongoCollection      = config.String("mongo-collection-name", "avatars")
+	MongoDialTimeout     = config.Duration("mongo-dial-timeout", 5*time.Second)
+	MongoReconnectPeriod = config.Duration("mongo-reconnect-period", time.Second)
 )
 
-// Connect to MongoDB and returns session clone.
-func getSession() *mgo.Session {
-	if mgoSession == nil {
-		var err error
-		mgoSession, err = mgo.Dial(*mongoUrl)
+// Interval of retries to create indexes while MongoDB is unavailable.
+const indexRetryInterval = 10 * time.Second
+
+var (
+	mgoSession  *mgo.Session
+	mgoMutex    sync.Mutex
+	mgoDialing  chan struct{}
+	mgoLastDial time.Time
+	mgoDialErr  error
+)
+
+// Connect to MongoDB and returns session copy. If the server is not
+// available the error is returned and the connection is retried by the
+// next call, but not more often than "mongo-reconnect-period".
+func getSession() (*mgo.Session, error) {
+	return getContextSession(context.Background())
+}
+
+// Connect to MongoDB within "mongo-dial-timeout" and the context deadline
+// and returns session copy. Only one connection is dialed at a time, other
+// callers wait for it without holding the lock.
+func connectSession(ctx context.Context) (*mgo.Session, error) {
+	mgoMutex.Lock()
+	for mgoSession == nil {
+		if dialing := mgoDialing; dialing != nil {
+			mgoMutex.Unlock()
+			select {
+			case <-dialing:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			mgoMutex.Lock()
+			continue
+		}
+		if mgoDialErr != nil && time.Since(mgoLastDial) < *MongoReconnectPeriod {
+			err := mgoDialErr
+			mgoMutex.Unlock()
+			return nil, err
+		}
+
+		timeout := *MongoDialTimeout
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+		dialing := make(chan struct{})
+		mgoDialing = dialing
+		mgoMutex.Unlock()
+
+		session, err := mgo.DialWithTimeout(*mongoUrl, timeout)
+
+		mgoMutex.Lock()
+		mgoSession, mgoDialErr, mgoDialing, mgoLastDial = session, err, nil, time.Now()
+		close(dialing)
 		if err != nil {
-			panic(err)
+			mgoMutex.Unlock()
+			return nil, contextError(ctx, err)
 		}
 	}
-	return mgoSession.Clone()
+	defer mgoMutex.Unlock()
+	return mgoSession.Copy(), nil
 }
 
-func getObjectWithDatabase(fn func(*mgo.Database) (interface{}, error)) (interface{}, error) {
-	session := getSession()
+// Get session copy which respects the context: the connection is dialed
+// and its socket timeout is set by the context deadline. The copy has its
+// own socket, so the timeout doesn't affect other requests.
+func getContextSession(ctx context.Context) (*mgo.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session, err := connectSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			session.Close()
+			return nil, context.DeadlineExceeded
+		}
+		session.SetSocketTimeout(timeout)
+		session.SetSyncTimeout(timeout)
+	}
+	return session, nil
+}
+
+// Replace the error by the context error if the context is done, so the
+// caller can tell timeouts from storage failures.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Check that MongoDB responds to ping before the context is done. The
+// sockets of the session are reset on failure, so the following requests
+// reconnect instead of reusing broken connections.
+func PingStorage(ctx context.Context) error {
+	session, err := getContextSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if err = session.Ping(); err != nil {
+		mgoMutex.Lock()
+		if mgoSession != nil {
+			mgoSession.Refresh()
+		}
+		mgoMutex.Unlock()
+	}
+	return contextError(ctx, err)
+}
+
+// Close the connection to MongoDB.
+func closeSession() {
+	mgoMutex.Lock()
+	defer mgoMutex.Unlock()
+
+	if mgoSession != nil {
+		mgoSession.Close()
+		mgoSession = nil
+	}
+}
+
+func getObjectWithDatabase(ctx context.Context, fn func(*mgo.Database) (interface{}, error)) (interface{}, error) {
+	session, err := getContextSession(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer session.Close()
 	db := session.DB(*MongoDatabase)
-	return fn(db)
+	result, err := fn(db)
+	return result, contextError(ctx, err)
 }
 
-func withDatabase(fn func(*mgo.Database) error) error {
-	session := getSession()
+func withDatabase(ctx context.Context, fn func(*mgo.Database) error) error {
+	session, err := getContextSession(ctx)
+	if err != nil {
+		return err
+	}
 	defer session.Close()
 	db := session.DB(*MongoDatabase)
-	return fn(db)
+	return contextError(ctx, fn(db))
 }
 
-func withCollection(collection string, fn func(*mgo.Collection) error) error {
-	session := getSession()
+func withCollection(ctx context.Context, collection string, fn func(*mgo.Collection) error) error {
+	session, err := getContextSession(ctx)
+	if err != nil {
+		return err
+	}
 	defer session.Close()
 	c := session.DB(*MongoDatabase).C(collection)
-	return fn(c)
+	return contextError(ctx, fn(c))
+}
+
+func GetAvatarStructById(ctx context.Context, id string) (searchResult *Avatar, err error) {
+	ctx, end := startStorageOperation(ctx, "find_avatar")
+	defer end(&err)
+	searchResult, err = getAvatarStruct(ctx, *MongoCollection, bson.M{"_id": id})
+	return
+}
+
+// Get the avatars with the given ids by one query. Ids which are not found
+// are skipped.
+func GetAvatarsByIds(ctx context.Context, ids []string) (avatars []*Avatar, err error) {
+	ctx, end := startStorageOperation(ctx, "find_avatars")
+	defer end(&err)
+	err = withCollection(ctx, *MongoCollection, func(c *mgo.Collection) error {
+		return c.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&avatars)
+	})
+	for _, avatar := range avatars {
+		avatar.setUrls()
+	}
+	return
+}
+
+// Create indexes of the listing sort fields. They are built in background,
+// so the collection stays available.
+func EnsureIndexes(ctx context.Context) (err error) {
+	ctx, end := startStorageOperation(ctx, "ensure_indexes")
+	defer end(&err)
+	return withCollection(ctx, *MongoCollection, func(c *mgo.Collection) error {
+		for _, field := range listSortFields {
+			if field == "_id" {
+				continue
+			}
+			if err := c.EnsureIndex(mgo.Index{Key: []string{field, "_id"}, Background: true}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Create indexes once MongoDB is available. Should be run in a goroutine
+// at startup.
+func watchIndexes() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), *MongoDialTimeout)
+		err := EnsureIndexes(ctx)
+		cancel()
+		if err == nil {
+			return
+		}
+		logger.Warn("indexes are not created", "error", err)
+		time.Sleep(indexRetryInterval)
+	}
 }
 
-func GetAvatarStructById(id string) (searchResult *Avatar, err error) {
-	searchResult, err = getAvatarStruct(*MongoCollection, bson.M{"_id": id})
+// Get the page of avatars by the filter. One avatar more than the limit is
+// returned if there are more pages.
+func ListAvatars(ctx context.Context, filter *AvatarFilter) (avatars []*Avatar, err error) {
+	ctx, end := startStorageOperation(ctx, "list_avatars")
+	defer end(&err)
+	err = withCollection(ctx, *MongoCollection, func(c *mgo.Collection) error {
+		return c.Find(filter.query()).Sort(filter.sortKeys()...).Limit(filter.Limit + 1).All(&avatars)
+	})
+	for _, avatar := range avatars {
+		avatar.setUrls()
+	}
 	return
 }
 
-func getAvatarStruct(collectionName string, q interface{}) (searchResult *Avatar, err error) {
+// Get the avatar with metadata of its images. Metadata of the avatars
+// created before it was stored is read from GridFS once and stored.
+func GetAvatarMetaById(ctx context.Context, id string) (avatar *Avatar, err error) {
+	ctx, end := startStorageOperation(ctx, "avatar_meta")
+	defer end(&err)
+	query := func(db *mgo.Database) error {
+		avatar = &Avatar{}
+		if err := db.C(*MongoCollection).FindId(id).One(avatar); err != nil {
+			return err
+		}
+		avatar.setUrls()
+		if avatar.Original != nil && avatar.Thumbnail != nil {
+			return nil
+		}
+
+		gridFs := db.GridFS(*GridFsPrefix)
+		file, err := gridFs.OpenId(avatar.Origin)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		config, format, _ := image.DecodeConfig(newContextReader(ctx, file))
+		avatar.Filename, avatar.Format = file.Name(), format
+		avatar.Original = gridFileMeta(file, image.Rect(0, 0, config.Width, config.Height))
+		avatar.Created, avatar.Updated = file.UploadDate(), file.UploadDate()
+
+		avatar.Thumbnail = avatar.Original
+		if avatar.Thumb != avatar.Origin {
+			thumb, err := gridFs.OpenId(avatar.Thumb)
+			if err != nil {
+				return err
+			}
+			defer thumb.Close()
+			config, _, _ := image.DecodeConfig(newContextReader(ctx, thumb))
+			avatar.Thumbnail = gridFileMeta(thumb, image.Rect(0, 0, config.Width, config.Height))
+			avatar.Updated = thumb.UploadDate()
+		}
+
+		// store the metadata, so GridFS is read once; skipped if the
+		// avatar is replaced meanwhile
+		err = db.C(*MongoCollection).Update(
+			bson.M{"_id": id, "origin": avatar.Origin, "thumb": avatar.Thumb},
+			bson.M{"$set": bson.M{
+				"filename":  avatar.Filename,
+				"format":    avatar.Format,
+				"original":  avatar.Original,
+				"thumbnail": avatar.Thumbnail,
+				"created":   avatar.Created,
+				"updated":   avatar.Updated,
+			}},
+		)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	err = withDatabase(ctx, query)
+	return
+}
+
+func getAvatarStruct(ctx context.Context, collectionName string, q interface{}) (searchResult *Avatar, err error) {
 	searchResult = &Avatar{}
 	query := func(c *mgo.Collection) error {
 		err := c.Find(q).One(&searchResult)
 		return err
 	}
 	search := func() error {
-		return withCollection(collectionName, query)
+		return withCollection(ctx, collectionName, query)
 	}
 	err = search()
 	if err != nil {
@@ -77,15 +329,17 @@ func getAvatarStruct(collectionName string, q interface{}) (searchResult *Avatar
 	return
 }
 
-func GetOriginalImageById(id string) (file interface{}, err error) {
-	return getImageById(id, true)
+func GetOriginalImageById(ctx context.Context, id string) (file interface{}, err error) {
+	return getImageById(ctx, id, true)
 }
 
-func GetThumbnailImageById(id string) (file interface{}, err error) {
-	return getImageById(id, false)
+func GetThumbnailImageById(ctx context.Context, id string) (file interface{}, err error) {
+	return getImageById(ctx, id, false)
 }
 
-func getImageById(id string, isOrigin bool) (file interface{}, err error) {
+func getImageById(ctx context.Context, id string, isOrigin bool) (file interface{}, err error) {
+	ctx, end := startStorageOperation(ctx, "read_image")
+	defer end(&err)
 	query := func(db *mgo.Database) (interface{}, error) {
 		result := &Avatar{}
 		err = db.C(*MongoCollection).FindId(id).One(&result)
@@ -107,12 +361,12 @@ func getImageById(id string, isOrigin bool) (file interface{}, err error) {
 
 		var arr []byte
 		buf := bytes.NewBuffer(arr)
-		_, err = io.Copy(buf, gridFile)
+		_, err = io.Copy(buf, newContextReader(ctx, gridFile))
 
 		return buf, err
 	}
 	search := func() (interface{}, error) {
-		return getObjectWithDatabase(query)
+		return getObjectWithDatabase(ctx, query)
 	}
 	file, err = search()
 	if err != nil {
@@ -121,219 +375,370 @@ func getImageById(id string, isOrigin bool) (file interface{}, err error) {
 	return
 }
 
-func InsertImage(id string, fileBytesArray []byte, filename string, isNew bool) (err error) {
-	if err = checkForExistedImage(id, isNew); err != nil {
-		return err
-	}
+// Open the original image file and pass it to fn. The file is closed after
+// fn returns, so it should not be used outside of fn.
+func WithOriginalImage(ctx context.Context, id string, fn func(*mgo.GridFile) error) error {
+	return withImage(ctx, id, true, fn)
+}
 
-	query := func(db *mgo.Database) (err error) {
-		var storedFile *mgo.GridFile
-		storedFile, err = db.GridFS(*GridFsPrefix).Create(filename)
-		if err != nil {
-			return
+// Open the thumbnail image file and pass it to fn. Metadata and content
+// read from the file always belong to the same version of the image.
+func WithThumbnailImage(ctx context.Context, id string, fn func(*mgo.GridFile) error) error {
+	return withImage(ctx, id, false, fn)
+}
+
+func withImage(ctx context.Context, id string, isOrigin bool, fn func(*mgo.GridFile) error) (err error) {
+	ctx, end := startStorageOperation(ctx, "open_image")
+	defer end(&err)
+	query := func(db *mgo.Database) error {
+		result := &Avatar{}
+		if err := db.C(*MongoCollection).FindId(id).One(&result); err != nil {
+			return err
 		}
-		defer storedFile.Close()
 
-		_, err = io.Copy(storedFile, bytes.NewReader(fileBytesArray))
+		imageId := result.Thumb
+		if isOrigin {
+			imageId = result.Origin
+		}
+		gridFile, err := db.GridFS(*GridFsPrefix).OpenId(imageId)
 		if err != nil {
-			return
+			return err
 		}
+		defer gridFile.Close()
 
-		fileid := storedFile.Id().(bson.ObjectId)
-		url := ApiUrl + "file/" + id
-		err = db.C(*MongoCollection).Insert(&Avatar{
-			Id:        id,
-			UrlOrigin: url + "/raw",
-			UrlThumb:  url,
-			Origin:    fileid,
-			Thumb:     fileid,
-		})
-		return err
+		return fn(gridFile)
 	}
-	search := func() (err error) {
-		return withDatabase(query)
+	err = withDatabase(ctx, query)
+	return
+}
+
+func GetOriginalImageInfoById(ctx context.Context, id string) (info *ImageInfo, err error) {
+	return getImageInfoById(ctx, id, true)
+}
+
+func GetThumbnailImageInfoById(ctx context.Context, id string) (info *ImageInfo, err error) {
+	return getImageInfoById(ctx, id, false)
+}
+
+// Get GridFS metadata of the image without reading its content.
+func getImageInfoById(ctx context.Context, id string, isOrigin bool) (info *ImageInfo, err error) {
+	ctx, end := startStorageOperation(ctx, "image_info")
+	defer end(&err)
+	query := func(db *mgo.Database) error {
+		result := &Avatar{}
+		if err := db.C(*MongoCollection).FindId(id).One(&result); err != nil {
+			return err
+		}
+
+		imageId := result.Thumb
+		if isOrigin {
+			imageId = result.Origin
+		}
+
+		gridFile, err := db.GridFS(*GridFsPrefix).OpenId(imageId)
+		if err != nil {
+			return err
+		}
+		defer gridFile.Close()
+
+		meta := struct {
+			SHA256 string `bson:"sha256"`
+		}{}
+		gridFile.GetMeta(&meta)
+
+		info = &ImageInfo{
+			Id:         imageId,
+			Name:       gridFile.Name(),
+			MD5:        gridFile.MD5(),
+			SHA256:     meta.SHA256,
+			Size:       gridFile.Size(),
+			UploadDate: gridFile.UploadDate(),
+		}
+		return nil
 	}
-	err = search()
+	err = withDatabase(ctx, query)
+	return
+}
+
+func InsertImage(ctx context.Context, id string, fileBytesArray []byte, filename string, isNew bool) (err error) {
+	return insertImageFromReader(ctx, id, bytes.NewReader(fileBytesArray), filename, nil, isNew)
+}
+
+func InsertImageAndThumbnail(ctx context.Context, id string, fileBytesArray []byte, filename string, mask []int, isNew bool) (err error) {
+	return insertImageFromReader(ctx, id, bytes.NewReader(fileBytesArray), filename, mask, isNew)
+}
+
+func insertImageFromReader(ctx context.Context, id string, r io.Reader, filename string, mask []int, isNew bool) (err error) {
+	info, err := StoreImageFile(ctx, r, filename)
 	if err != nil {
 		return
 	}
-	return
+	return InsertAvatar(ctx, id, info.Id, mask, isNew)
 }
 
-func InsertImageAndThumbnail(id string, fileBytesArray []byte, filename string, mask []int, isNew bool) (err error) {
-	if err = checkForExistedImage(id, isNew); err != nil {
-		return err
+// Stream the image into GridFS. SHA-256 hash of the content is computed on
+// the fly and stored in the file metadata. Partially written file is removed
+// if the reader fails.
+func StoreImageFile(ctx context.Context, r io.Reader, filename string) (info *ImageInfo, err error) {
+	ctx, end := startStorageOperation(ctx, "store_image")
+	defer end(&err)
+	query := func(db *mgo.Database) error {
+		storedFile, err := db.GridFS(*GridFsPrefix).Create(filename)
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.New()
+		if _, err = io.Copy(storedFile, io.TeeReader(newContextReader(ctx, r), hash)); err != nil {
+			storedFile.Abort()
+			storedFile.Close()
+			return err
+		}
+		sum := hex.EncodeToString(hash.Sum(nil))
+		storedFile.SetMeta(bson.M{"sha256": sum})
+		if err = storedFile.Close(); err != nil {
+			return err
+		}
+
+		info = &ImageInfo{
+			Id:         storedFile.Id().(bson.ObjectId),
+			Name:       storedFile.Name(),
+			MD5:        storedFile.MD5(),
+			SHA256:     sum,
+			Size:       storedFile.Size(),
+			UploadDate: storedFile.UploadDate(),
+		}
+		return nil
 	}
+	err = withDatabase(ctx, query)
+	return
+}
 
-	query := func(db *mgo.Database) (err error) {
-		var storedFile, storedThumbFile *mgo.GridFile
-		storedFile, err = db.GridFS(*GridFsPrefix).Create(filename)
+// Remove the image file from GridFS.
+func RemoveImageFile(ctx context.Context, fileId bson.ObjectId) (err error) {
+	ctx, end := startStorageOperation(ctx, "remove_image")
+	defer end(&err)
+	err = withDatabase(ctx, func(db *mgo.Database) error {
+		return db.GridFS(*GridFsPrefix).RemoveId(fileId)
+	})
+	return
+}
+
+// Create avatar from the stored original image file. The thumbnail is cut
+// by the mask, or by the smart crop if the mask is nil; the origin is used
+// as the thumbnail if it is already square. The original file is removed if
+// the avatar can't be created.
+func InsertAvatar(ctx context.Context, id string, origin bson.ObjectId, mask []int, isNew bool) (err error) {
+	ctx, end := startStorageOperation(ctx, "insert_avatar")
+	defer end(&err)
+	defer func() {
 		if err != nil {
-			return
+			RemoveImageFile(context.Background(), origin)
 		}
-		defer storedFile.Close()
+	}()
 
-		storedThumbFile, err = db.GridFS(*GridFsPrefix).Create("thumb_" + filename)
+	// replaced avatar keeps its creation time
+	now := time.Now().UTC()
+	created := now
+	if isNew {
+		if err = checkForExistedImage(ctx, id); err != nil {
+			return err
+		}
+	} else {
+		previous, err := GetAvatarStructById(ctx, id)
 		if err != nil {
-			return
+			return err
 		}
-		defer storedThumbFile.Close()
+		if !previous.Created.IsZero() {
+			created = previous.Created
+		}
+	}
 
-		_, err = io.Copy(storedFile, bytes.NewReader(fileBytesArray))
+	query := func(db *mgo.Database) error {
+		file, err := db.GridFS(*GridFsPrefix).OpenId(origin)
 		if err != nil {
-			return
+			return err
 		}
+		defer file.Close()
 
-		file := bytes.NewReader(fileBytesArray)
+		img, filetype, decodeErr := image.Decode(newContextReader(ctx, file))
+		var bounds image.Rectangle
+		if decodeErr == nil {
+			bounds = img.Bounds()
+		}
+		if mask == nil && decodeErr == nil {
+			if crop := smartCropMask(img); !image.Rect(crop[0], crop[1], crop[2], crop[3]).Eq(bounds) {
+				mask = crop
+			}
+		}
 
-		img, filetype, err := image.Decode(file)
+		avatar := &Avatar{
+			Id:       id,
+			Origin:   origin,
+			Thumb:    origin,
+			Filename: file.Name(),
+			Format:   filetype,
+			Mask:     mask,
+			Original: gridFileMeta(file, bounds),
+			Created:  created,
+			Updated:  now,
+		}
+		avatar.Thumbnail = avatar.Original
+		if mask != nil {
+			if decodeErr != nil {
+				return decodeErr
+			}
+			if avatar.Thumb, avatar.Thumbnail, err = createThumbnail(db, img, filetype, file.Name(), mask); err != nil {
+				return err
+			}
+		}
+		thumb := avatar.Thumb
+		avatar.setUrls()
+
+		// the previous avatar is replaced only when the new one is ready, and
+		// its files are removed after that, so failures keep it in place
+		previous := &Avatar{}
+		if isNew {
+			err = db.C(*MongoCollection).Insert(avatar)
+			if mgo.IsDup(err) {
+				err = errAvatarExists
+			}
+		} else {
+			_, err = db.C(*MongoCollection).FindId(id).Apply(mgo.Change{Update: avatar, Upsert: true}, previous)
+		}
 		if err != nil {
-			return
+			if thumb != origin {
+				db.GridFS(*GridFsPrefix).RemoveId(thumb)
+			}
+			return err
+		}
+		if previous.Origin != "" {
+			removePreviousFiles(db, previous)
 		}
+		return nil
+	}
+	err = withDatabase(ctx, query)
+	return
+}
 
-		rect := image.Rect(mask[0], mask[1], mask[2], mask[3])
-
-		var thumb image.Image
-		switch pic := img.(type) {
-		case *image.NRGBA:
-			thumb = pic.SubImage(rect)
-		case *image.NRGBA64:
-			thumb = pic.SubImage(rect)
-		case *image.RGBA:
-			thumb = pic.SubImage(rect)
-		case *image.RGBA64:
-			thumb = pic.SubImage(rect)
-		case *image.Gray:
-			thumb = pic.SubImage(rect)
-		case *image.Gray16:
-			thumb = pic.SubImage(rect)
-		case *image.YCbCr:
-			thumb = pic.SubImage(rect)
-		case *image.Paletted:
-			thumb = pic.SubImage(rect)
-		default:
-			return errors.New(`can't convert image`)
-		}
-
-		switch filetype {
-		case "jpeg", "jpg":
-			jpeg.Encode(storedThumbFile, thumb, nil)
-		case "bmp":
-			bmp.Encode(storedThumbFile, thumb)
-		case "png":
-			png.Encode(storedThumbFile, thumb)
-		case "gif":
-			gif.Encode(storedThumbFile, thumb, nil)
-		}
-
-		fileId := storedFile.Id().(bson.ObjectId)
-		thumbFileId := storedThumbFile.Id().(bson.ObjectId)
-		url := ApiUrl + "file/" + id
-
-		err = db.C(*MongoCollection).Insert(&Avatar{
-			Id:        id,
-			UrlOrigin: url + "/raw",
-			UrlThumb:  url,
-			Origin:    fileId,
-			Thumb:     thumbFileId,
-		})
-		return err
+// Get metadata of the GridFS file of the image with the given bounds.
+func gridFileMeta(file *mgo.GridFile, bounds image.Rectangle) *ImageMeta {
+	meta := struct {
+		SHA256 string `bson:"sha256"`
+	}{}
+	file.GetMeta(&meta)
+	return &ImageMeta{
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		Size:   file.Size(),
+		MD5:    file.MD5(),
+		SHA256: meta.SHA256,
 	}
-	search := func() (err error) {
-		return withDatabase(query)
+}
+
+// Cut the thumbnail from the image by the mask and store it in GridFS with
+// the same format as the original file.
+func createThumbnail(db *mgo.Database, img image.Image, filetype string, filename string, mask []int) (thumbFileId bson.ObjectId, meta *ImageMeta, err error) {
+	if err = checkMaskRect(mask); err != nil {
+		return
 	}
-	err = search()
+	rect := image.Rect(mask[0], mask[1], mask[2], mask[3])
+	if !rect.In(img.Bounds()) {
+		err = errMaskOutOfBounds
+		return
+	}
+	thumb, err := cropImage(img, rect)
 	if err != nil {
 		return
 	}
-	return
+
+	storedThumbFile, err := db.GridFS(*GridFsPrefix).Create("thumb_" + filename)
+	if err != nil {
+		return
+	}
+
+	hash := sha256.New()
+	w := io.MultiWriter(storedThumbFile, hash)
+	switch filetype {
+	case "jpeg", "jpg":
+		err = jpeg.Encode(w, thumb, nil)
+	case "bmp":
+		err = bmp.Encode(w, thumb)
+	case "png":
+		err = png.Encode(w, thumb)
+	case "gif":
+		err = gif.Encode(w, thumb, nil)
+	}
+	if err != nil {
+		storedThumbFile.Abort()
+		storedThumbFile.Close()
+		return
+	}
+	storedThumbFile.SetMeta(bson.M{"sha256": hex.EncodeToString(hash.Sum(nil))})
+	if err = storedThumbFile.Close(); err != nil {
+		return
+	}
+	return storedThumbFile.Id().(bson.ObjectId), gridFileMeta(storedThumbFile, thumb.Bounds()), nil
 }
 
-func ChangeThumbnail(id string, mask []int) (result interface{}, err error) {
+func ChangeThumbnail(ctx context.Context, id string, mask []int) (result interface{}, err error) {
+	ctx, end := startStorageOperation(ctx, "change_thumbnail")
+	defer end(&err)
 	query := func(db *mgo.Database) (interface{}, error) {
 		var err error
 		searchResult := &Avatar{}
 		if err = db.C(*MongoCollection).FindId(id).One(&searchResult); err != nil {
 			return nil, err
 		}
-		if searchResult.Origin != searchResult.Thumb {
-			if err = db.GridFS(*GridFsPrefix).RemoveId(searchResult.Thumb); err != nil {
-				return nil, err
-			}
+		oldThumb := searchResult.Thumb
+		// the size of the stored image is known without decoding
+		if original := searchResult.Original; original != nil &&
+			!image.Rect(mask[0], mask[1], mask[2], mask[3]).In(image.Rect(0, 0, original.Width, original.Height)) {
+			return nil, errMaskOutOfBounds
 		}
 
 		file, err := db.GridFS(*GridFsPrefix).OpenId(searchResult.Origin)
 		if err != nil {
 			return nil, err
 		}
+		defer file.Close()
 
-		var storedThumbFile *mgo.GridFile
-		storedThumbFile, err = db.GridFS(*GridFsPrefix).Create("thumb_" + file.Name())
+		img, filetype, err := image.Decode(newContextReader(ctx, file))
 		if err != nil {
 			return nil, err
 		}
-		defer storedThumbFile.Close()
 
-		var arr []byte
-		buf := bytes.NewBuffer(arr)
-		_, err = io.Copy(buf, file)
-		if err != nil {
-			return nil, err
-		}
-		img, filetype, err := image.Decode(buf)
+		searchResult.Thumb, searchResult.Thumbnail, err = createThumbnail(db, img, filetype, file.Name(), mask)
 		if err != nil {
 			return nil, err
 		}
-		rect := image.Rect(mask[0], mask[1], mask[2], mask[3])
-
-		var thumb image.Image
-
-		switch pic := img.(type) {
-		case *image.NRGBA:
-			thumb = pic.SubImage(rect)
-		case *image.NRGBA64:
-			thumb = pic.SubImage(rect)
-		case *image.RGBA:
-			thumb = pic.SubImage(rect)
-		case *image.RGBA64:
-			thumb = pic.SubImage(rect)
-		case *image.Gray:
-			thumb = pic.SubImage(rect)
-		case *image.Gray16:
-			thumb = pic.SubImage(rect)
-		case *image.YCbCr:
-			thumb = pic.SubImage(rect)
-		case *image.Paletted:
-			thumb = pic.SubImage(rect)
-		default:
-			return nil, errors.New(`can't convert image`)
-		}
-
-		switch filetype {
-		case "jpeg", "jpg":
-			jpeg.Encode(storedThumbFile, thumb, nil)
-		case "bmp":
-			bmp.Encode(storedThumbFile, thumb)
-		case "png":
-			png.Encode(storedThumbFile, thumb)
-		case "gif":
-			gif.Encode(storedThumbFile, thumb, nil)
-		}
-
-		thumbFileId := storedThumbFile.Id().(bson.ObjectId)
-		change := bson.M{"$set": bson.M{"thumb": thumbFileId}}
+		searchResult.setUrls()
+		change := bson.M{"$set": bson.M{
+			"thumb":     searchResult.Thumb,
+			"url_thumb": searchResult.UrlThumb,
+			"mask":      mask,
+			"thumbnail": searchResult.Thumbnail,
+			"updated":   time.Now().UTC(),
+		}}
 		err = db.C(*MongoCollection).UpdateId(id, change)
 		if err != nil {
 			return nil, err
 		}
 
+		// the previous thumbnail is removed only after the new one is in place
+		if oldThumb != searchResult.Origin {
+			if err = db.GridFS(*GridFsPrefix).RemoveId(oldThumb); err != nil {
+				return nil, err
+			}
+		}
+
 		result := &Avatar{}
 		err = db.C(*MongoCollection).FindId(id).One(&result)
 
 		return result, err
 	}
 	search := func() (result interface{}, err error) {
-		return getObjectWithDatabase(query)
+		return getObjectWithDatabase(ctx, query)
 	}
 	result, err = search()
 	if err != nil {
@@ -342,7 +747,9 @@ func ChangeThumbnail(id string, mask []int) (result interface{}, err error) {
 	return
 }
 
-func DeleteImage(id string) (err error) {
+func DeleteImage(ctx context.Context, id string) (err error) {
+	ctx, end := startStorageOperation(ctx, "delete_image")
+	defer end(&err)
 	query := func(db *mgo.Database) (err error) {
 		result := Avatar{}
 		if err = db.C(*MongoCollection).FindId(id).One(&result); err != nil {
@@ -362,7 +769,7 @@ func DeleteImage(id string) (err error) {
 		return
 	}
 	search := func() (err error) {
-		return withDatabase(query)
+		return withDatabase(ctx, query)
 	}
 	err = search()
 	if err != nil {
@@ -371,20 +778,55 @@ func DeleteImage(id string) (err error) {
 	return
 }
 
-func checkForExistedImage(id string, isNew bool) error {
-	var err error
-	if isNew {
-		_, err = GetAvatarStructById(id)
-		if err == nil {
-			return errors.New("avatar for this user is already exists")
-		} else if err.Error() != "not found" {
-			return err
-		}
-	} else {
-		err = DeleteImage(id)
-		if err != nil {
-			return err
-		}
+var errAvatarExists = errors.New("avatar for this user is already exists")
+
+func checkForExistedImage(ctx context.Context, id string) error {
+	_, err := GetAvatarStructById(ctx, id)
+	if err == nil {
+		return errAvatarExists
+	} else if err.Error() != "not found" {
+		return err
 	}
 	return nil
 }
+
+// Remove the files of the replaced avatar. The avatar is already replaced,
+// so failures are logged only and leave orphaned files.
+func removePreviousFiles(db *mgo.Database, previous *Avatar) {
+	gridFs := db.GridFS(*GridFsPrefix)
+	if err := gridFs.RemoveId(previous.Origin); err != nil {
+		logger.Warn("file of the replaced avatar is not removed", "avatar_id", previous.Id, "error", err)
+	}
+	if previous.Thumb != previous.Origin {
+		if err := gridFs.RemoveId(previous.Thumb); err != nil {
+			logger.Warn("file of the replaced avatar is not removed", "avatar_id", previous.Id, "error", err)
+		}
+	}
+}
+
+// Count stored avatars.
+func CountAvatars(ctx context.Context) (count int, err error) {
+	err = withCollection(ctx, *MongoCollection, func(c *mgo.Collection) error {
+		count, err = c.Count()
+		return err
+	})
+	return
+}
+
+// Get the total size of the files stored in GridFS.
+func StoredBytes(ctx context.Context) (size int64, err error) {
+	err = withCollection(ctx, *GridFsPrefix+".files", func(c *mgo.Collection) error {
+		result := struct {
+			Size int64 `bson:"size"`
+		}{}
+		pipeline := []bson.M{{"$group": bson.M{"_id": nil, "size": bson.M{"$sum": "$length"}}}}
+		err := c.Pipe(pipeline).One(&result)
+		if err == mgo.ErrNotFound {
+			// no files at all
+			return nil
+		}
+		size = result.Size
+		return err
+	})
+	return
+}
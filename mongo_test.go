@@ -2,9 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/png"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/zenazn/goji/web"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type MongoSuiteTester struct {
@@ -54,22 +70,22 @@ func (suite *MongoSuiteTester) TestInsertImage() {
 	isNew := true
 
 	// WHEN I upload the file
-	err := InsertImage(suite.id, suite.image, suite.filename, isNew)
+	err := InsertImage(context.Background(), suite.id, suite.image, suite.filename, isNew)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND get Avatar struct
-	avatar, err := GetAvatarStructById(suite.id)
+	avatar, err := GetAvatarStructById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// THEN user id should equal avatar id
 	suite.Equal(suite.id, avatar.Id)
-	// AND original image id should equal thumbnail image id
-	suite.Equal(avatar.Origin, avatar.Thumb)
+	// AND original image id should not equal thumbnail image id for non-square image
+	suite.NotEqual(avatar.Origin, avatar.Thumb)
 
 	// WHEN I get original image from database
-	buf, err := GetOriginalImageById(suite.id)
+	buf, err := GetOriginalImageById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
@@ -78,13 +94,17 @@ func (suite *MongoSuiteTester) TestInsertImage() {
 	suite.Equal(file.Bytes(), suite.image)
 
 	// WHEN I get thumbnail image from database
-	buf, err = GetThumbnailImageById(suite.id)
+	buf, err = GetThumbnailImageById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	file = buf.(*bytes.Buffer)
-	// THEN thumbnail image should equal stored file
-	suite.Equal(file.Bytes(), suite.image)
+	// THEN thumbnail image should be square
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal(cfg.Width, cfg.Height)
 }
 
 // Test inserting image and replacing with new image
@@ -93,28 +113,28 @@ func (suite *MongoSuiteTester) TestInsertImageAndReplaceWithNewImage() {
 	isNew := true
 
 	// WHEN I upload the file
-	err := InsertImage(suite.id, suite.image, suite.filename, isNew)
+	err := InsertImage(context.Background(), suite.id, suite.image, suite.filename, isNew)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND upload thumbnail file to replace stored image
 	isNew = false
-	err = InsertImage(suite.id, suite.thumb, suite.thumbname, isNew)
+	err = InsertImage(context.Background(), suite.id, suite.thumb, suite.thumbname, isNew)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND get Avatar struct
-	avatar, err := GetAvatarStructById(suite.id)
+	avatar, err := GetAvatarStructById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// THEN user id should equal avatar id
 	suite.Equal(suite.id, avatar.Id)
-	// AND original image id should equal thumbnail image id
-	suite.Equal(avatar.Origin, avatar.Thumb)
+	// AND original image id should not equal thumbnail image id for non-square image
+	suite.NotEqual(avatar.Origin, avatar.Thumb)
 
 	// WHEN I get original image from database
-	buf, err := GetOriginalImageById(suite.id)
+	buf, err := GetOriginalImageById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
@@ -123,13 +143,17 @@ func (suite *MongoSuiteTester) TestInsertImageAndReplaceWithNewImage() {
 	suite.Equal(file.Bytes(), suite.thumb)
 
 	// WHEN I get thumbnail image from database
-	buf, err = GetThumbnailImageById(suite.id)
+	buf, err = GetThumbnailImageById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	file = buf.(*bytes.Buffer)
-	// THEN thumbnail image should equal stored thumbnail file
-	suite.Equal(file.Bytes(), suite.thumb)
+	// THEN thumbnail image should be square
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal(cfg.Width, cfg.Height)
 }
 
 // Test inserting image and thumbnail
@@ -140,12 +164,12 @@ func (suite *MongoSuiteTester) TestInsertImageAndThumbnail() {
 	mask := Mask{Mask: []int{70, 15, 250, 130}}
 
 	// WHEN I upload the file with given mask
-	err := InsertImageAndThumbnail(suite.id, suite.image, suite.filename, mask.Mask, isNew)
+	err := InsertImageAndThumbnail(context.Background(), suite.id, suite.image, suite.filename, mask.Mask, isNew)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND get Avatar struct
-	avatar, err := GetAvatarStructById(suite.id)
+	avatar, err := GetAvatarStructById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
@@ -155,7 +179,7 @@ func (suite *MongoSuiteTester) TestInsertImageAndThumbnail() {
 	suite.NotEqual(avatar.Origin, avatar.Thumb)
 
 	// WHEN I get original image from database
-	buf, err := GetOriginalImageById(suite.id)
+	buf, err := GetOriginalImageById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
@@ -164,7 +188,7 @@ func (suite *MongoSuiteTester) TestInsertImageAndThumbnail() {
 	suite.Equal(file.Bytes(), suite.image)
 
 	// WHEN I get thumbnail image from database
-	buf, err = GetThumbnailImageById(suite.id)
+	buf, err = GetThumbnailImageById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
@@ -181,18 +205,18 @@ func (suite *MongoSuiteTester) TestInsertImageAndThumbnailAndReplaceWithNewImage
 	mask := Mask{Mask: []int{70, 15, 250, 130}}
 
 	// WHEN I upload the file with given mask
-	err := InsertImageAndThumbnail(suite.id, suite.image, suite.filename, mask.Mask, isNew)
+	err := InsertImageAndThumbnail(context.Background(), suite.id, suite.image, suite.filename, mask.Mask, isNew)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND upload thumbnail file to replace stored image with given mask
 	isNew = false
-	err = InsertImageAndThumbnail(suite.id, suite.thumb, suite.thumbname, mask.Mask, isNew)
+	err = InsertImageAndThumbnail(context.Background(), suite.id, suite.thumb, suite.thumbname, mask.Mask, isNew)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND get Avatar struct
-	avatar, err := GetAvatarStructById(suite.id)
+	avatar, err := GetAvatarStructById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
@@ -202,7 +226,7 @@ func (suite *MongoSuiteTester) TestInsertImageAndThumbnailAndReplaceWithNewImage
 	suite.NotEqual(avatar.Origin, avatar.Thumb)
 
 	// WHEN I get original image from database
-	buf, err := GetOriginalImageById(suite.id)
+	buf, err := GetOriginalImageById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
@@ -211,7 +235,7 @@ func (suite *MongoSuiteTester) TestInsertImageAndThumbnailAndReplaceWithNewImage
 	suite.Equal(file.Bytes(), suite.thumb)
 
 	// WHEN I get thumbnail image from database
-	buf, err = GetThumbnailImageById(suite.id)
+	buf, err = GetThumbnailImageById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
@@ -228,18 +252,18 @@ func (suite *MongoSuiteTester) TestChangeMask() {
 	mask := Mask{Mask: []int{70, 15, 250, 130}}
 
 	// WHEN I upload the file with given mask
-	err := InsertImageAndThumbnail(suite.id, suite.image, suite.filename, mask.Mask, isNew)
+	err := InsertImageAndThumbnail(context.Background(), suite.id, suite.image, suite.filename, mask.Mask, isNew)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND get Avatar struct
-	avatar, err := GetAvatarStructById(suite.id)
+	avatar, err := GetAvatarStructById(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND change mask to stored file
 	mask = Mask{Mask: []int{10, 10, 20, 20}}
-	avatarInterface, err := ChangeThumbnail(suite.id, mask.Mask)
+	avatarInterface, err := ChangeThumbnail(context.Background(), suite.id, mask.Mask)
 	avatarNew := avatarInterface.(*Avatar)
 	// THEN user id before changing should equal user id after changing
 	suite.Equal(avatar.Id, avatarNew.Id)
@@ -247,6 +271,92 @@ func (suite *MongoSuiteTester) TestChangeMask() {
 	suite.Equal(avatar.Origin, avatarNew.Origin)
 	// THEN thumbnail id before changing should not equal thumbnail id after changing
 	suite.NotEqual(avatar.Thumb, avatarNew.Thumb)
+
+	// WHEN I change mask to the rectangle outside the image
+	_, err = ChangeThumbnail(context.Background(), suite.id, []int{10, 10, 1000, 20})
+	// THEN mask should be rejected
+	suite.Equal(errMaskOutOfBounds, err)
+}
+
+// Test metadata of the avatar
+func (suite *MongoSuiteTester) TestAvatarMeta() {
+	// GIVEN image uploaded with mask
+	mask := Mask{Mask: []int{70, 15, 250, 130}}
+	err := InsertImageAndThumbnail(context.Background(), suite.id, suite.image, suite.filename, mask.Mask, true)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	config, _, _ := image.DecodeConfig(bytes.NewReader(suite.image))
+
+	// WHEN I get avatar metadata
+	avatar, err := GetAvatarMetaById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// THEN file name, format and mask should be stored
+	suite.Equal(suite.filename, avatar.Filename)
+	suite.Equal("png", avatar.Format)
+	suite.Equal(mask.Mask, avatar.Mask)
+	// AND original image metadata should describe uploaded file
+	suite.Equal(config.Width, avatar.Original.Width)
+	suite.Equal(config.Height, avatar.Original.Height)
+	suite.Equal(int64(len(suite.image)), avatar.Original.Size)
+	suite.Len(avatar.Original.SHA256, 64)
+	// AND thumbnail metadata should describe cropped image
+	suite.Equal(mask.Mask[2]-mask.Mask[0], avatar.Thumbnail.Width)
+	suite.False(avatar.Created.IsZero())
+	created := avatar.Created
+
+	// WHEN I change the mask
+	_, err = ChangeThumbnail(context.Background(), suite.id, []int{10, 10, 20, 20})
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	avatar, err = GetAvatarMetaById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// THEN creation time should be kept
+	suite.True(created.Equal(avatar.Created))
+	// AND mask and thumbnail metadata should be updated
+	suite.Equal([]int{10, 10, 20, 20}, avatar.Mask)
+	suite.Equal(10, avatar.Thumbnail.Width)
+	suite.False(avatar.Updated.Before(created))
+}
+
+// Test metadata of the avatar stored before it was added
+func (suite *MongoSuiteTester) TestLegacyAvatarMeta() {
+	// GIVEN avatar without stored metadata
+	err := InsertImage(context.Background(), suite.id, suite.image, suite.filename, true)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	err = suite.db.C(*MongoCollection).UpdateId(suite.id, bson.M{"$unset": bson.M{
+		"filename": "", "format": "", "original": "", "thumbnail": "", "created": "", "updated": "",
+		"url_origin": "", "url_thumb": "",
+	}})
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+
+	// WHEN I get avatar metadata
+	avatar, err := GetAvatarMetaById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// THEN metadata should be read from GridFS
+	suite.Equal("png", avatar.Format)
+	suite.Equal(int64(len(suite.image)), avatar.Original.Size)
+	// AND versioned URLs should be set
+	suite.Equal(ApiUrl+"file/"+suite.id+"?"+VersionParam+"="+avatar.Thumb.Hex(), avatar.UrlThumb)
+	// AND metadata should be stored
+	stored := &Avatar{}
+	if err = suite.db.C(*MongoCollection).FindId(suite.id).One(stored); err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal("png", stored.Format)
+	suite.Equal(avatar.Original.SHA256, stored.Original.SHA256)
+	suite.False(stored.Created.IsZero())
 }
 
 // Test deleting image
@@ -255,17 +365,17 @@ func (suite *MongoSuiteTester) TestDeleteImage() {
 	isNew := true
 
 	// WHEN I upload the file
-	err := InsertImage(suite.id, suite.image, suite.filename, isNew)
+	err := InsertImage(context.Background(), suite.id, suite.image, suite.filename, isNew)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND delete this file
-	err = DeleteImage(suite.id)
+	err = DeleteImage(context.Background(), suite.id)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND get Avatar struct
-	_, err = GetAvatarStructById(suite.id)
+	_, err = GetAvatarStructById(context.Background(), suite.id)
 	// THEN 'not found' error should be raised
 	suite.Equal(err.Error(), "not found")
 }
@@ -273,7 +383,7 @@ func (suite *MongoSuiteTester) TestDeleteImage() {
 // Test errors raising
 func (suite *MongoSuiteTester) TestErrors() {
 	// WHEN I trying to delete file which is not existed
-	err := DeleteImage(suite.id)
+	err := DeleteImage(context.Background(), suite.id)
 	// THEN 'not found' error should be raised
 	if err.Error() != "not found" {
 		suite.T().Error(err.Error())
@@ -281,19 +391,392 @@ func (suite *MongoSuiteTester) TestErrors() {
 
 	// WHEN I upload the file
 	isNew := true
-	err = InsertImage(suite.id, suite.image, suite.filename, isNew)
+	err = InsertImage(context.Background(), suite.id, suite.image, suite.filename, isNew)
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
 	// AND trying to upload another file with 'new' flag
 	isNew = true
-	err = InsertImage(suite.id, suite.thumb, suite.thumbname, isNew)
+	err = InsertImage(context.Background(), suite.id, suite.thumb, suite.thumbname, isNew)
 	// THEN 'already exists' error should be raised
 	if err.Error() != "avatar for this user is already exists" {
 		suite.T().Error(err.Error())
 	}
 }
 
+// Test bulk lookup of avatars
+func (suite *MongoSuiteTester) TestBatchGet() {
+	// GIVEN uploaded file
+	err := InsertImage(context.Background(), suite.id, suite.image, suite.filename, true)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// AND id without avatar
+	missing := RandomMD5()
+	// AND router with bulk lookup handler
+	mux := web.New()
+	mux.Post(BatchGetUrl, BatchGetFiles)
+	batchGet := func(body string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("POST", BatchGetUrl, strings.NewReader(body))
+		if err != nil {
+			suite.T().Error(err.Error())
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// WHEN I look up both ids
+	w := batchGet(`{"ids": ["` + missing + `", "` + suite.id + `", "` + suite.id + `"]}`)
+	// THEN response status code should be 200
+	suite.Equal(http.StatusOK, w.Code)
+	var result BatchGetResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		suite.T().Error(err.Error())
+	}
+	// AND existing avatar should be returned once with its URLs
+	suite.Len(result.Avatars, 1)
+	suite.Equal(suite.id, result.Avatars[0].Id)
+	suite.NotEmpty(result.Avatars[0].UrlThumb)
+	// AND the other id should be missing
+	suite.Equal([]string{missing}, result.Missing)
+
+	// WHEN I look up invalid id
+	w = batchGet(`{"ids": ["user"]}`)
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+
+	// WHEN I look up no ids
+	w = batchGet(`{"ids": []}`)
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+}
+
+// Test listing avatars page by page
+func (suite *MongoSuiteTester) TestListAvatars() {
+	// GIVEN indexes of the sort fields
+	if err := EnsureIndexes(context.Background()); err != nil {
+		suite.T().Error(err.Error())
+	}
+	indexes, err := suite.db.C(*MongoCollection).Indexes()
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	keys := []string{}
+	for _, index := range indexes {
+		keys = append(keys, strings.Join(index.Key, ","))
+	}
+	suite.Contains(keys, "created,_id")
+
+	// AND three uploaded files
+	ids := []string{suite.id, RandomMD5(), RandomMD5()}
+	for _, id := range ids {
+		err := InsertImage(context.Background(), id, suite.image, suite.filename, true)
+		if err != nil {
+			suite.T().Error(err.Error())
+		}
+	}
+	defer func() {
+		for _, id := range ids {
+			DeleteImage(context.Background(), id)
+		}
+	}()
+	// AND filter of the avatars created by the test sorted by creation time
+	filter, err := parseAvatarFilter(url.Values{"sort": {"-created"}, "limit": {"2"}})
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	since, err := GetAvatarMetaById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	filter.CreatedAfter = since.Created
+
+	// WHEN I get the first page
+	avatars, err := ListAvatars(context.Background(), filter)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// THEN it should contain one avatar more than the limit
+	suite.Len(avatars, 3)
+
+	// WHEN I get the page after the second avatar
+	filter.Cursor = listCursorOf(avatars[1], filter)
+	next, err := ListAvatars(context.Background(), filter)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// THEN it should contain the third avatar only
+	suite.Len(next, 1)
+	suite.Equal(avatars[2].Id, next[0].Id)
+}
+
+// Test uploading JSON and raw body
+func (suite *MongoSuiteTester) TestUploadVariants() {
+	// GIVEN router with upload handlers
+	mux := web.New()
+	mux.Post("/:id", UploadFile)
+	mux.Put("/:id", UpdateFile)
+
+	// WHEN I upload base64 encoded file with mask
+	body, _ := json.Marshal(JsonUpload{Data: base64.StdEncoding.EncodeToString(suite.image), Mask: []int{70, 15, 250, 130}, Filename: suite.filename})
+	r, err := http.NewRequest("POST", "/"+suite.id, bytes.NewReader(body))
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	// THEN response status code should be 201
+	suite.Equal(http.StatusCreated, w.Code)
+	// AND thumbnail should be cut by the mask
+	avatar, err := GetAvatarMetaById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal(suite.filename, avatar.Filename)
+	suite.Equal([]int{70, 15, 250, 130}, avatar.Mask)
+
+	// WHEN I replace it by raw body with mask in query
+	r, err = http.NewRequest("PUT", "/"+suite.id+"?mask=10,10,20,20", bytes.NewReader(suite.thumb))
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.Header.Set("Content-Type", "image/png")
+	r.Header.Set("Content-Disposition", `attachment; filename="`+suite.thumbname+`"`)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	// THEN response status code should be 201
+	suite.Equal(http.StatusCreated, w.Code)
+	// AND original image should equal uploaded body
+	buf, err := GetOriginalImageById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal(suite.thumb, buf.(*bytes.Buffer).Bytes())
+	avatar, err = GetAvatarMetaById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal(suite.thumbname, avatar.Filename)
+	suite.Equal([]int{10, 10, 20, 20}, avatar.Mask)
+}
+
+// Test uploading with the mask outside the image
+func (suite *MongoSuiteTester) TestUploadMaskOutOfBounds() {
+	// GIVEN router with upload handler
+	mux := web.New()
+	mux.Post("/:id", UploadFile)
+
+	// WHEN I upload the file with the mask larger than the image
+	body, _ := json.Marshal(JsonUpload{Data: base64.StdEncoding.EncodeToString(suite.image), Mask: []int{0, 0, 100000, 100000}})
+	r, err := http.NewRequest("POST", "/"+suite.id, bytes.NewReader(body))
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	// THEN response status code should be 400
+	suite.Equal(http.StatusBadRequest, w.Code)
+	suite.Contains(w.Body.String(), errMaskOutOfBounds.Error())
+	// AND avatar should not be stored
+	_, err = GetAvatarMetaById(context.Background(), suite.id)
+	suite.Error(err)
+}
+
+// Test importing image from remote URL
+func (suite *MongoSuiteTester) TestImport() {
+	// GIVEN remote server with the image behind redirect
+	remote := http.NewServeMux()
+	remote.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/"+suite.filename, http.StatusFound)
+	})
+	fetched := 0
+	remote.HandleFunc("/"+suite.filename, func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Write(suite.image)
+	})
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	allowImportIP = func(ip net.IP) bool { return ip.IsLoopback() }
+	defer func() { allowImportIP = isPublicIP }()
+	// AND router with import handler
+	mux := web.New()
+	mux.Post("/:id/import", ImportFile)
+
+	// WHEN I import the image
+	r, err := http.NewRequest("POST", "/"+suite.id+"/import", strings.NewReader(`{"url": "`+server.URL+`/redirect"}`))
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	// THEN response status code should be 201
+	suite.Equal(http.StatusCreated, w.Code)
+	// AND original image should equal remote file
+	buf, err := GetOriginalImageById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal(suite.image, buf.(*bytes.Buffer).Bytes())
+	// AND file name should be taken from the final URL
+	avatar, err := GetAvatarMetaById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal(suite.filename, avatar.Filename)
+
+	// WHEN I import the image again
+	r, err = http.NewRequest("POST", "/"+suite.id+"/import", strings.NewReader(`{"url": "`+server.URL+`/redirect"}`))
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	// THEN response status code should be 409
+	suite.Equal(http.StatusConflict, w.Code)
+	// AND the file should not be fetched
+	suite.Equal(1, fetched)
+}
+
+// Test resizing to huge sizes
+func (suite *MongoSuiteTester) TestResizeLimits() {
+	// GIVEN uploaded file
+	err := InsertImage(context.Background(), suite.id, suite.image, suite.filename, true)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	mux := web.New()
+	mux.Get("/:id", GetResizedFile)
+
+	for _, query := range []string{"w=100000&h=100000", "w=0&h=10", "s=4096"} {
+		// WHEN I request the image of invalid size
+		r, err := http.NewRequest("GET", "/"+suite.id+"?"+query, nil)
+		if err != nil {
+			suite.T().Error(err.Error())
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		// THEN response status code should be 400
+		suite.Equal(http.StatusBadRequest, w.Code, query)
+	}
+}
+
+// Test default image parameters of the uploaded avatar
+func (suite *MongoSuiteTester) TestDefaultParamsOfUploadedAvatar() {
+	// GIVEN uploaded file
+	err := InsertImage(context.Background(), suite.id, suite.image, suite.filename, true)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// AND router with resized file handler
+	mux := web.New()
+	mux.Get("/:id", GetResizedFile)
+
+	// WHEN I request the avatar with default image parameter only
+	r, err := http.NewRequest("GET", "/"+suite.id+"?d=identicon", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	// THEN response status code should be 200
+	suite.Equal(http.StatusOK, w.Code)
+	// AND the thumbnail should be served
+	buf, err := GetThumbnailImageById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal(buf.(*bytes.Buffer).Bytes(), w.Body.Bytes())
+}
+
+// Test ETag of the thumbnail
+func (suite *MongoSuiteTester) TestThumbnailETag() {
+	// GIVEN uploaded file
+	err := InsertImage(context.Background(), suite.id, suite.image, suite.filename, true)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// AND router with resized file handler
+	mux := web.New()
+	mux.Get("/:id", GetResizedFile)
+
+	// WHEN I request the thumbnail
+	r, err := http.NewRequest("GET", "/"+suite.id, nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	// THEN ETag should be the hash of the served content
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal(fmt.Sprintf(`"%x"`, md5.Sum(w.Body.Bytes())), w.Header().Get("ETag"))
+}
+
+// Test failed replacing of the image
+func (suite *MongoSuiteTester) TestFailedReplaceKeepsAvatar() {
+	// GIVEN uploaded file
+	err := InsertImage(context.Background(), suite.id, suite.image, suite.filename, true)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// AND stored file which is not an image
+	info, err := StoreImageFile(context.Background(), strings.NewReader("not an image"), "broken.png")
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+
+	// WHEN I replace the image by the broken file with mask
+	err = InsertAvatar(context.Background(), suite.id, info.Id, []int{0, 0, 10, 10}, false)
+	// THEN error should be raised
+	suite.Error(err)
+	// AND previous image should be kept
+	buf, err := GetOriginalImageById(context.Background(), suite.id)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	suite.Equal(suite.image, buf.(*bytes.Buffer).Bytes())
+}
+
+// Test streaming original image by ranges
+func (suite *MongoSuiteTester) TestOriginalImageRange() {
+	// GIVEN uploaded file
+	err := InsertImage(context.Background(), suite.id, suite.image, suite.filename, true)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	// AND router with original file handler
+	mux := web.New()
+	mux.Get("/:id/raw", GetOriginalFile)
+
+	// WHEN I request the first 10 bytes of original image
+	r, err := http.NewRequest("GET", "/"+suite.id+"/raw", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.Header.Set("Range", "bytes=0-9")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	// THEN response status code should be 206
+	suite.Equal(http.StatusPartialContent, w.Code)
+	// AND response should contain requested bytes
+	suite.Equal(suite.image[:10], w.Body.Bytes())
+	suite.Equal("image/png", w.Header().Get("Content-Type"))
+
+	// WHEN I send HEAD request
+	r, err = http.NewRequest("HEAD", "/"+suite.id+"/raw", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	// THEN response should contain length of the file without the body
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal(strconv.Itoa(len(suite.image)), w.Header().Get("Content-Length"))
+	suite.Equal(0, w.Body.Len())
+}
+
 // TestRunMongoSuite will be run by the 'go test' command
 func TestRunMongoSuite(t *testing.T) {
 	Run(t, new(MongoSuiteTester))
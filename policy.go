@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/drone/config"
+	"github.com/zenazn/goji/web"
+)
+
+var (
+	AuthAdminScope = config.String("auth-admin-scope", "avatars:admin")
+	AuthOwnerClaim = config.String("auth-owner-claim", "sub")
+	AuthEmailClaim = config.String("auth-email-claim", "email")
+)
+
+// Policy decides whether the principal may modify the avatar with the id.
+type Policy interface {
+	CanModify(principal *Principal, id string) bool
+}
+
+// PolicyFunc is an adapter to use ordinary functions as policies.
+type PolicyFunc func(principal *Principal, id string) bool
+
+func (f PolicyFunc) CanModify(principal *Principal, id string) bool {
+	return f(principal, id)
+}
+
+// OwnerPolicy allows principals to modify their own avatars only. Admins
+// and services may modify any avatar.
+type OwnerPolicy struct {
+	// Scope which allows to modify any avatar.
+	AdminScope string
+	// AvatarIds maps the principal to the ids of avatars it owns.
+	AvatarIds func(principal *Principal) []string
+}
+
+func (p *OwnerPolicy) CanModify(principal *Principal, id string) bool {
+	if principal.IsService() || (p.AdminScope != "" && principal.HasScope(p.AdminScope)) {
+		return true
+	}
+	for _, ownId := range p.AvatarIds(principal) {
+		if strings.EqualFold(ownId, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get avatar ids of the principal: the value of the owner claim and the MD5
+// hash of the email claim the way Gravatar builds it.
+func claimAvatarIds(principal *Principal) []string {
+	var ids []string
+	if owner, ok := principal.Claims[*AuthOwnerClaim].(string); ok && owner != "" {
+		ids = append(ids, owner)
+	}
+	if email, ok := principal.Claims[*AuthEmailClaim].(string); ok && email != "" {
+		ids = append(ids, fmt.Sprintf("%x", md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))))
+	}
+	return ids
+}
+
+// WritePolicy is checked before any avatar is modified. Replace it to map
+// user ids to avatar ids differently. The admin scope of the default policy
+// is set from the configuration by initAuth.
+var WritePolicy Policy = &OwnerPolicy{
+	AdminScope: "avatars:admin",
+	AvatarIds:  claimAvatarIds,
+}
+
+// RequireAdmin allows the request to admins and services only. Reading is
+// public by default, so the request is authenticated here if Auth has not
+// done it. Nobody is admin if authentication is disabled.
+func RequireAdmin(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.enabled() {
+			JsonResponseMsg(w, http.StatusForbidden, `admin access requires authentication`)
+			return
+		}
+
+		principal := GetPrincipal(*c)
+		if principal == nil {
+			var err error
+			if principal, err = auth.authenticate(r); err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="avatars"`)
+				JsonResponseMsg(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+		}
+		if !principal.IsService() && (*AuthAdminScope == "" || !principal.HasScope(*AuthAdminScope)) {
+			JsonResponseMsg(w, http.StatusForbidden, `admin access required`)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Check whether the authenticated principal may modify the avatar of the
+// "Id" URL parameter. Should be used after CheckId middleware.
+func Authorize(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.enabled() || isReadRequest(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		principal := GetPrincipal(*c)
+		if principal == nil {
+			JsonResponseMsg(w, http.StatusUnauthorized, errNoCredentials.Error())
+			return
+		}
+		if !WritePolicy.CanModify(principal, c.URLParams["id"]) {
+			JsonResponseMsg(w, http.StatusForbidden, `access to this avatar is forbidden`)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
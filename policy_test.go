@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+type PolicySuiteTester struct {
+	BaseSuite
+
+	mux *web.Mux
+	id  string
+}
+
+// Settings for suite
+func (suite *PolicySuiteTester) SetupSuite() {
+	// INIT router with principal set by the test header, "CheckId" and "Authorize" middlewares
+	setPrincipal := func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.Env = map[interface{}]interface{}{}
+			switch r.Header.Get("X-Test-Principal") {
+			case "owner":
+				c.Env[PrincipalEnvKey] = &Principal{Claims: map[string]interface{}{"sub": suite.id}}
+			case "email":
+				// md5("user@example.com")
+				c.Env[PrincipalEnvKey] = &Principal{Claims: map[string]interface{}{"email": " User@Example.com"}}
+			case "admin":
+				c.Env[PrincipalEnvKey] = &Principal{Scopes: []string{"avatars:admin"}}
+			case "other":
+				c.Env[PrincipalEnvKey] = &Principal{Claims: map[string]interface{}{"sub": RandomMD5()}}
+			case "cert":
+				if principal, err := auth.authenticate(r); err == nil {
+					c.Env[PrincipalEnvKey] = principal
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	router := func(c web.C, w http.ResponseWriter, r *http.Request) {}
+
+	suite.mux = web.New()
+	suite.mux.Use(setPrincipal)
+	RouterWithId := web.New()
+	RouterWithId.Use(CheckId)
+	RouterWithId.Use(Authorize)
+	RouterWithId.Get("/:id", router)
+	RouterWithId.Delete("/:id", router)
+	suite.mux.Handle("/:id", RouterWithId)
+	AdminRouter := web.New()
+	AdminRouter.Use(RequireAdmin)
+	AdminRouter.Get("/admin/files", router)
+	suite.mux.Handle("/admin/files", AdminRouter)
+}
+
+// Settings for each test
+func (suite *PolicySuiteTester) SetupTest() {
+	// INIT enabled authentication and random avatar id
+	auth = &authConfig{apiKeys: []string{"key"}}
+	suite.id = RandomMD5()
+}
+
+// Restore settings after each test
+func (suite *PolicySuiteTester) TearDownTest() {
+	auth = &authConfig{}
+}
+
+// Send request of the avatar with the given principal.
+func (suite *PolicySuiteTester) request(method string, id string, principal string) int {
+	r, err := http.NewRequest(method, "/"+id, nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.Header.Set("X-Test-Principal", principal)
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+// Send request of the avatar with verified client certificate of the subject.
+func (suite *PolicySuiteTester) requestWithCert(method string, id string, subject string) int {
+	r, err := http.NewRequest(method, "/"+id, nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: subject}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	r.Header.Set("X-Test-Principal", "cert")
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+// Test modifying avatars by different principals
+func (suite *PolicySuiteTester) TestModify() {
+	// THEN owner should modify own avatar
+	suite.Equal(http.StatusOK, suite.request("DELETE", suite.id, "owner"))
+	// AND admin should modify any avatar
+	suite.Equal(http.StatusOK, suite.request("DELETE", suite.id, "admin"))
+	// AND other user should not modify the avatar
+	suite.Equal(http.StatusForbidden, suite.request("DELETE", suite.id, "other"))
+	// AND anonymous user should not modify the avatar
+	suite.Equal(http.StatusUnauthorized, suite.request("DELETE", suite.id, ""))
+	// AND anyone should read the avatar
+	suite.Equal(http.StatusOK, suite.request("GET", suite.id, ""))
+}
+
+// Test modifying avatar by hashed email
+func (suite *PolicySuiteTester) TestEmail() {
+	suite.Equal(http.StatusOK, suite.request("DELETE", "b58996c504c5638798eb6b511e6f49af", "email"))
+	suite.Equal(http.StatusForbidden, suite.request("DELETE", suite.id, "email"))
+}
+
+// Test custom policy
+func (suite *PolicySuiteTester) TestCustomPolicy() {
+	// GIVEN policy which allows nothing
+	defaultPolicy := WritePolicy
+	WritePolicy = PolicyFunc(func(principal *Principal, id string) bool { return false })
+	defer func() { WritePolicy = defaultPolicy }()
+
+	// THEN owner should not modify own avatar
+	suite.Equal(http.StatusForbidden, suite.request("DELETE", suite.id, "owner"))
+}
+
+// Test admin only routes
+func (suite *PolicySuiteTester) TestRequireAdmin() {
+	// THEN admin should list avatars
+	suite.Equal(http.StatusOK, suite.request("GET", "admin/files", "admin"))
+	// AND other user should not list avatars
+	suite.Equal(http.StatusForbidden, suite.request("GET", "admin/files", "owner"))
+	// AND anonymous user should not list avatars
+	suite.Equal(http.StatusUnauthorized, suite.request("GET", "admin/files", ""))
+
+	// WHEN I send API key of the service
+	r, err := http.NewRequest("GET", "/admin/files", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.Header.Set("api_key", "key")
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	// THEN service should list avatars
+	suite.Equal(http.StatusOK, w.Code)
+
+	// GIVEN client certificates of the listed service
+	auth.clientCerts = true
+	auth.serviceCerts = []string{"uploader"}
+	// THEN service should list avatars and modify any avatar
+	suite.Equal(http.StatusOK, suite.requestWithCert("GET", "admin/files", "uploader"))
+	suite.Equal(http.StatusOK, suite.requestWithCert("DELETE", suite.id, "uploader"))
+	// AND valid certificate which is not listed should not
+	suite.Equal(http.StatusForbidden, suite.requestWithCert("GET", "admin/files", "other"))
+	suite.Equal(http.StatusForbidden, suite.requestWithCert("DELETE", suite.id, "other"))
+
+	// GIVEN disabled authentication
+	auth = &authConfig{}
+	// THEN nobody should list avatars
+	suite.Equal(http.StatusForbidden, suite.request("GET", "admin/files", "admin"))
+	suite.Equal(http.StatusForbidden, suite.request("GET", "admin/files", ""))
+}
+
+// TestRunPolicySuite will be run by the 'go test' command
+func TestRunPolicySuite(t *testing.T) {
+	Run(t, new(PolicySuiteTester))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drone/config"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+var (
+	RateLimitReadRpm      = config.Int("ratelimit-read-rpm", 600)
+	RateLimitReadBurst    = config.Int("ratelimit-read-burst", 100)
+	RateLimitResizeRpm    = config.Int("ratelimit-resize-rpm", 120)
+	RateLimitResizeBurst  = config.Int("ratelimit-resize-burst", 30)
+	RateLimitWriteRpm     = config.Int("ratelimit-write-rpm", 30)
+	RateLimitWriteBurst   = config.Int("ratelimit-write-burst", 10)
+	RateLimitTrustedProxy = config.String("ratelimit-trusted-proxies", "")
+)
+
+// Buckets which were not used for this time are removed.
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket is refilled with "rate" tokens per second up to "burst" tokens.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps token buckets of the clients.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Create limiter which allows "perMinute" requests per minute on average
+// and "burst" requests at once. Limiter is disabled if "perMinute" is zero.
+func newRateLimiter(perMinute int, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Take a token of the client. Returns whether the request is allowed, the
+// number of remaining tokens, the time to wait for the next token and the
+// time to refill the bucket completely.
+func (l *rateLimiter) take(key string, now time.Time) (ok bool, remaining int, wait time.Duration, reset time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		wait = l.duration(1 - b.tokens)
+	}
+	return ok, int(b.tokens), wait, l.duration(l.burst - b.tokens)
+}
+
+// Check whether the client has a token without taking it. Returns the time
+// to wait for the next token otherwise.
+func (l *rateLimiter) ready(key string, now time.Time) (ok bool, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	return false, l.duration(1 - b.tokens)
+}
+
+// Get the bucket of the client refilled by the time passed. Should be
+// called with the lock held.
+func (l *rateLimiter) refill(key string, now time.Time) *tokenBucket {
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+func (l *rateLimiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// Remove buckets which are refilled completely.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+var (
+	readLimiter    *rateLimiter
+	resizeLimiter  *rateLimiter
+	writeLimiter   *rateLimiter
+	trustedProxies []*net.IPNet
+)
+
+// Load rate limits. Should be called after the configuration is parsed.
+func initRateLimit() error {
+	readLimiter = newRateLimiter(*RateLimitReadRpm, *RateLimitReadBurst)
+	resizeLimiter = newRateLimiter(*RateLimitResizeRpm, *RateLimitResizeBurst)
+	writeLimiter = newRateLimiter(*RateLimitWriteRpm, *RateLimitWriteBurst)
+
+	trustedProxies = nil
+	for _, cidr := range splitList(*RateLimitTrustedProxy) {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+// Get the limiter of the request: writing or reading. Resizing is limited
+// by the handlers which transform stored images, see limitResize.
+func requestLimiter(r *http.Request) *rateLimiter {
+	if !isReadRequest(r) {
+		return writeLimiter
+	}
+	return readLimiter
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get IP address of the client. "X-Forwarded-For" header is used only if
+// the request came from a trusted proxy: the rightmost address which is not
+// a trusted proxy is the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		forwardedIP := net.ParseIP(addr)
+		if forwardedIP == nil {
+			break
+		}
+		host = addr
+		if !isTrustedProxy(forwardedIP) {
+			break
+		}
+	}
+	return host
+}
+
+// Get the key of the client: API key or JWT subject of the authenticated
+// principal, or the client IP address.
+func rateLimitKey(c web.C, r *http.Request) string {
+	if principal := GetPrincipal(c); principal != nil && principal.Subject != "" {
+		return "principal:" + principal.Subject
+	}
+	return "ip:" + clientIP(r)
+}
+
+// Check whether the request carries any credentials.
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("api_key") != "" || r.Header.Get("Authorization") != "" || clientCertificate(r) != nil
+}
+
+// Take a token of the client from the limiter and set rate limit headers.
+// Responds with 429 status code and returns false if the client is limited.
+func takeToken(w http.ResponseWriter, limiter *rateLimiter, key string) bool {
+	ok, remaining, wait, reset := limiter.take(key, time.Now())
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(int(limiter.burst)))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	if !ok {
+		tooManyRequests(w, wait)
+	}
+	return ok
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	JsonResponseMsg(w, http.StatusTooManyRequests, `too many requests`)
+}
+
+// Limit resizing of the stored image. Should be called when the image is
+// going to be transformed, not for cached responses or default images.
+// Returns false if the response is sent.
+func limitResize(c web.C, w http.ResponseWriter, r *http.Request) bool {
+	if resizeLimiter == nil {
+		return true
+	}
+	return takeToken(w, resizeLimiter, rateLimitKey(c, r))
+}
+
+// RateLimit limits anonymous requests by the client IP address before
+// authentication. Requests with credentials are limited by the principal
+// in RateLimitPrincipal, but failed authentications are counted in the
+// separate bucket of the IP address, so guessing keys is limited too. While
+// the bucket is empty credentials from the address are not checked at all.
+// Reading and writing are limited here, resizing by limitResize. Should be
+// used before Auth middleware.
+func RateLimit(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := requestLimiter(r)
+		if limiter == nil || r.Method == "OPTIONS" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !hasCredentials(r) {
+			if takeToken(w, limiter, "ip:"+clientIP(r)) {
+				h.ServeHTTP(w, r)
+			}
+			return
+		}
+
+		key := "auth-ip:" + clientIP(r)
+		if ok, wait := limiter.ready(key, time.Now()); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		ww := mutil.WrapWriter(w)
+		h.ServeHTTP(ww, r)
+		if ww.Status() == http.StatusUnauthorized {
+			limiter.take(key, time.Now())
+		}
+	})
+}
+
+// RateLimitPrincipal limits requests with credentials by the authenticated
+// principal, so clients behind the same proxy don't share the bucket.
+// Requests which are not authenticated, e.g. public reads, are limited by
+// the client IP address. Should be used after Auth middleware.
+func RateLimitPrincipal(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := requestLimiter(r)
+		if limiter == nil || r.Method == "OPTIONS" || !hasCredentials(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if takeToken(w, limiter, rateLimitKey(*c, r)) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+type RateLimitSuiteTester struct {
+	BaseSuite
+
+	mux *web.Mux
+}
+
+// Settings for suite
+func (suite *RateLimitSuiteTester) SetupSuite() {
+	// INIT router with "RateLimit" middleware
+	router := func(c web.C, w http.ResponseWriter, r *http.Request) {}
+	resizer := func(c web.C, w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("s") != "" {
+			limitResize(c, w, r)
+		}
+	}
+	// AND fake authentication by "Authorization: Bearer <subject>" header
+	authenticate := func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			subject := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subject == "bad" {
+				JsonResponseMsg(w, http.StatusUnauthorized, errInvalidToken.Error())
+				return
+			}
+			if subject != "" {
+				c.Env = map[interface{}]interface{}{PrincipalEnvKey: &Principal{Subject: subject}}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	suite.mux = web.New()
+	suite.mux.Use(RateLimit)
+	suite.mux.Use(authenticate)
+	suite.mux.Use(RateLimitPrincipal)
+	suite.mux.Get("/", resizer)
+	suite.mux.Post("/", router)
+}
+
+// Settings for each test
+func (suite *RateLimitSuiteTester) SetupTest() {
+	// INIT limits: 3 reads, 1 resize and no writes limit
+	readLimiter = newRateLimiter(60, 3)
+	resizeLimiter = newRateLimiter(60, 1)
+	writeLimiter = nil
+	trustedProxies = nil
+}
+
+// Restore settings after each test
+func (suite *RateLimitSuiteTester) TearDownTest() {
+	readLimiter, resizeLimiter, writeLimiter = nil, nil, nil
+	trustedProxies = nil
+}
+
+// Send request from the address.
+func (suite *RateLimitSuiteTester) request(method string, url string, addr string) *httptest.ResponseRecorder {
+	return suite.requestAs(method, url, addr, "")
+}
+
+// Send request from the address with the token of the subject.
+func (suite *RateLimitSuiteTester) requestAs(method string, url string, addr string, subject string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.RemoteAddr = addr
+	if subject != "" {
+		r.Header.Set("Authorization", "Bearer "+subject)
+	}
+	w := httptest.NewRecorder()
+	suite.mux.ServeHTTP(w, r)
+	return w
+}
+
+// Test refilling of the token bucket
+func (suite *RateLimitSuiteTester) TestTokenBucket() {
+	// GIVEN limiter of 1 token per second with burst of 2 tokens
+	limiter := newRateLimiter(60, 2)
+	now := time.Now()
+
+	// WHEN I take all tokens
+	ok, remaining, _, _ := limiter.take("client", now)
+	suite.True(ok)
+	suite.Equal(1, remaining)
+	ok, remaining, _, reset := limiter.take("client", now)
+	suite.True(ok)
+	suite.Equal(0, remaining)
+	suite.Equal(2*time.Second, reset)
+	// THEN next request should wait a second
+	ok, _, wait, _ := limiter.take("client", now)
+	suite.False(ok)
+	suite.Equal(time.Second, wait)
+	// AND other clients should not be limited
+	ok, _, _, _ = limiter.take("other", now)
+	suite.True(ok)
+
+	// WHEN a second passes
+	ok, _, _, _ = limiter.take("client", now.Add(time.Second))
+	// THEN request should be allowed
+	suite.True(ok)
+}
+
+// Test limiting requests by classes
+func (suite *RateLimitSuiteTester) TestMiddleware() {
+	// WHEN I resize the image twice
+	w := suite.request("GET", "/?s=10", "10.0.0.1:1234")
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal("1", w.Header().Get("RateLimit-Limit"))
+	suite.Equal("0", w.Header().Get("RateLimit-Remaining"))
+	w = suite.request("GET", "/?s=20", "10.0.0.1:1234")
+	// THEN second request should be limited
+	suite.Equal(http.StatusTooManyRequests, w.Code)
+	suite.Equal("1", w.Header().Get("Retry-After"))
+
+	// WHEN I read the image with parameters which don't resize it
+	w = suite.request("GET", "/?d=identicon", "10.0.0.1:1234")
+	// THEN reading should not be limited by resizing
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal("3", w.Header().Get("RateLimit-Limit"))
+	suite.Equal("0", w.Header().Get("RateLimit-Remaining"))
+
+	// WHEN I write without writing limit
+	w = suite.request("POST", "/", "10.0.0.1:1234")
+	// THEN request should be allowed without headers
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal("", w.Header().Get("RateLimit-Limit"))
+}
+
+// Test limiting authenticated clients behind the same address
+func (suite *RateLimitSuiteTester) TestPrincipals() {
+	// WHEN the first client resizes the image twice
+	w := suite.requestAs("GET", "/?s=10", "10.0.0.1:1234", "first")
+	suite.Equal(http.StatusOK, w.Code)
+	w = suite.requestAs("GET", "/?s=10", "10.0.0.1:1234", "first")
+	// THEN it should be limited
+	suite.Equal(http.StatusTooManyRequests, w.Code)
+
+	// WHEN the second client resizes the image from the same address
+	w = suite.requestAs("GET", "/?s=10", "10.0.0.1:1234", "second")
+	// THEN it should have its own bucket
+	suite.Equal(http.StatusOK, w.Code)
+	// AND anonymous clients of the address should have their own bucket too
+	w = suite.request("GET", "/?s=10", "10.0.0.1:1234")
+	suite.Equal(http.StatusOK, w.Code)
+}
+
+// Test limiting failed authentication
+func (suite *RateLimitSuiteTester) TestFailedAuth() {
+	// WHEN I send invalid token 3 times
+	for i := 0; i < 3; i++ {
+		w := suite.requestAs("GET", "/", "10.0.0.1:1234", "bad")
+		suite.Equal(http.StatusUnauthorized, w.Code)
+	}
+	// THEN next attempt should be limited
+	w := suite.requestAs("GET", "/", "10.0.0.1:1234", "bad")
+	suite.Equal(http.StatusTooManyRequests, w.Code)
+	// AND clients of other addresses should not be limited
+	w = suite.requestAs("GET", "/", "10.0.0.2:1234", "first")
+	suite.Equal(http.StatusOK, w.Code)
+	// AND anonymous clients of the address should not be limited
+	w = suite.request("GET", "/", "10.0.0.1:1234")
+	suite.Equal(http.StatusOK, w.Code)
+}
+
+// Test getting client address behind proxies
+func (suite *RateLimitSuiteTester) TestClientIP() {
+	// GIVEN trusted proxies
+	*RateLimitTrustedProxy = "10.0.0.0/8, 192.168.1.1"
+	if err := initRateLimit(); err != nil {
+		suite.T().Error(err.Error())
+	}
+	*RateLimitTrustedProxy = ""
+
+	cases := []struct {
+		remote, forwarded, expected string
+	}{
+		{"1.2.3.4:80", "5.6.7.8", "1.2.3.4"},
+		{"10.0.0.1:80", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:80", "spoofed, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"192.168.1.1:80", "", "192.168.1.1"},
+	}
+	for _, item := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = item.remote
+		if item.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", item.forwarded)
+		}
+		suite.Equal(item.expected, clientIP(r), item.remote+" "+item.forwarded)
+	}
+}
+
+// TestRunRateLimitSuite will be run by the 'go test' command
+func TestRunRateLimitSuite(t *testing.T) {
+	Run(t, new(RateLimitSuiteTester))
+}
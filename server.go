@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/drone/config"
+)
+
+var (
+	ReadTimeout       = config.Duration("http-read-timeout", time.Minute)
+	ReadHeaderTimeout = config.Duration("http-read-header-timeout", 10*time.Second)
+	WriteTimeout      = config.Duration("http-write-timeout", time.Minute)
+	IdleTimeout       = config.Duration("http-idle-timeout", 2*time.Minute)
+	MaxHeaderBytes    = config.Int("http-max-header-bytes", 64*1024)
+	ShutdownTimeout   = config.Duration("shutdown-timeout", 30*time.Second)
+)
+
+// Create server with the configured timeouts. The read timeout covers the
+// whole request body, so it should be long enough to upload MaxFileSize.
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              *Listen,
+		Handler:           handler,
+		ReadTimeout:       *ReadTimeout,
+		ReadHeaderTimeout: *ReadHeaderTimeout,
+		WriteTimeout:      *WriteTimeout,
+		IdleTimeout:       *IdleTimeout,
+		MaxHeaderBytes:    *MaxHeaderBytes,
+	}
+}
+
+// Serve connections of the listener until a signal is received. Then new
+// connections are refused and in-flight requests are drained for at most
+// "shutdown-timeout".
+func runServer(server *http.Server, l net.Listener, stop <-chan os.Signal) error {
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// certificates are provided by TLSConfig.GetCertificate
+			errs <- server.ServeTLS(l, "", "")
+		} else {
+			errs <- server.Serve(l)
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		logger.Info("shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *ShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
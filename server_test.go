@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type ServerSuiteTester struct {
+	BaseSuite
+}
+
+// Test draining of in-flight requests on shutdown
+func (suite *ServerSuiteTester) TestGracefulShutdown() {
+	// GIVEN server with slow handler
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- runServer(server, l, stop)
+	}()
+
+	// WHEN I send request
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+	<-started
+	// AND server is stopped while the request is in flight
+	stop <- syscall.SIGTERM
+	time.Sleep(50 * time.Millisecond)
+
+	// THEN new connections should be refused
+	_, err = net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	suite.Error(err)
+
+	// WHEN the request is finished
+	close(release)
+	// THEN it should be responded
+	suite.Equal("done", <-responses)
+	// AND server should be stopped without error
+	suite.NoError(<-stopped)
+}
+
+// TestRunServerSuite will be run by the 'go test' command
+func TestRunServerSuite(t *testing.T) {
+	Run(t, new(ServerSuiteTester))
+}
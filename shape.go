@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+)
+
+const (
+	ShapeCircle  = "circle"
+	ShapeRounded = "rounded"
+)
+
+// Number of samples per pixel side used to smooth the mask edges.
+const shapeSamples = 4
+
+// shapeMask is an alpha mask which covers the inscribed circle or the
+// rounded rectangle of the given bounds.
+type shapeMask struct {
+	rect   image.Rectangle
+	shape  string
+	radius float64
+}
+
+func (m *shapeMask) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (m *shapeMask) Bounds() image.Rectangle {
+	return m.rect
+}
+
+func (m *shapeMask) At(x, y int) color.Color {
+	covered := 0
+	for i := 0; i < shapeSamples; i++ {
+		for j := 0; j < shapeSamples; j++ {
+			fx := float64(x) + (float64(i)+0.5)/shapeSamples
+			fy := float64(y) + (float64(j)+0.5)/shapeSamples
+			if m.inside(fx, fy) {
+				covered++
+			}
+		}
+	}
+	return color.Alpha{uint8(covered * 0xff / (shapeSamples * shapeSamples))}
+}
+
+// Check whether the point lies inside the shape.
+func (m *shapeMask) inside(x, y float64) bool {
+	minX, minY := float64(m.rect.Min.X), float64(m.rect.Min.Y)
+	maxX, maxY := float64(m.rect.Max.X), float64(m.rect.Max.Y)
+
+	if m.shape == ShapeCircle {
+		cx, cy := (minX+maxX)/2, (minY+maxY)/2
+		r := math.Min(maxX-minX, maxY-minY) / 2
+		return (x-cx)*(x-cx)+(y-cy)*(y-cy) <= r*r
+	}
+
+	r := math.Min(m.radius, math.Min(maxX-minX, maxY-minY)/2)
+	// nearest corner center, the point is inside if it is not in a corner zone
+	cx := math.Max(minX+r, math.Min(x, maxX-r))
+	cy := math.Max(minY+r, math.Min(y, maxY-r))
+	return (x-cx)*(x-cx)+(y-cy)*(y-cy) <= r*r
+}
+
+// Cut the image with the given shape. Pixels outside of the shape become
+// transparent, or are filled with "bg" color if it is set.
+func applyShape(img image.Image, shape string, radius int, bg color.Color) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	if bg != nil {
+		draw.Draw(dst, dst.Bounds(), &image.Uniform{bg}, image.ZP, draw.Src)
+	}
+	mask := &shapeMask{rect: dst.Bounds(), shape: shape, radius: float64(radius)}
+	draw.DrawMask(dst, dst.Bounds(), img, bounds.Min, mask, image.ZP, draw.Over)
+	return dst
+}
+
+// Check whether the shape name is supported.
+func isValidShape(shape string) bool {
+	return shape == ShapeCircle || shape == ShapeRounded
+}
+
+// Parse color in "RRGGBB" or "RGB" hex form.
+func parseHexColor(s string) (color.Color, error) {
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return nil, errors.New(`color should be hex string "RRGGBB"`)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, errors.New(`color should be hex string "RRGGBB"`)
+	}
+	return color.NRGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
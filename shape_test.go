@@ -0,0 +1,76 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+type ShapeSuiteTester struct {
+	BaseSuite
+
+	img image.Image
+}
+
+// Settings for suite
+func (suite *ShapeSuiteTester) SetupSuite() {
+	// INIT opaque red square image
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0xff, 0, 0, 0xff}}, image.ZP, draw.Src)
+	suite.img = img
+}
+
+// Test cutting image with circle
+func (suite *ShapeSuiteTester) TestCircle() {
+	// WHEN I apply circle shape without background
+	result := applyShape(suite.img, ShapeCircle, 0, nil)
+	// THEN bounds should not change
+	suite.Equal(suite.img.Bounds(), result.Bounds())
+	// AND corner pixel should be transparent
+	_, _, _, a := result.At(0, 0).RGBA()
+	suite.Equal(uint32(0), a)
+	// AND center pixel should be opaque
+	_, _, _, a = result.At(32, 32).RGBA()
+	suite.Equal(uint32(0xffff), a)
+}
+
+// Test cutting image with rounded corners
+func (suite *ShapeSuiteTester) TestRounded() {
+	// WHEN I apply rounded shape with radius 10
+	result := applyShape(suite.img, ShapeRounded, 10, nil)
+	// THEN corner pixel should be transparent
+	_, _, _, a := result.At(0, 0).RGBA()
+	suite.Equal(uint32(0), a)
+	// AND edge pixel outside of the corners should be opaque
+	_, _, _, a = result.At(32, 0).RGBA()
+	suite.Equal(uint32(0xffff), a)
+}
+
+// Test filling cut corners with background
+func (suite *ShapeSuiteTester) TestBackground() {
+	// GIVEN white background
+	bg, err := parseHexColor("fff")
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+
+	// WHEN I apply circle shape with background
+	result := applyShape(suite.img, ShapeCircle, 0, bg)
+	// THEN corner pixel should be white
+	r, g, b, a := result.At(0, 0).RGBA()
+	suite.Equal([]uint32{0xffff, 0xffff, 0xffff, 0xffff}, []uint32{r, g, b, a})
+}
+
+// Test parsing invalid colors
+func (suite *ShapeSuiteTester) TestInvalidColor() {
+	for _, value := range []string{"", "ff", "gggggg", "1234567"} {
+		_, err := parseHexColor(value)
+		suite.Error(err, value)
+	}
+}
+
+// TestRunShapeSuite will be run by the 'go test' command
+func TestRunShapeSuite(t *testing.T) {
+	Run(t, new(ShapeSuiteTester))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	ModeSmart = "smart"
+)
+
+// Longest side of the grid which is used for saliency estimation.
+const smartCropGridSize = 64
+
+// Find the most salient rectangle with the given aspect ratio inside the
+// image. The rectangle is as large as possible and is moved along the longer
+// side of the image to the position with the largest edge energy.
+func smartCrop(img image.Image, width, height int) image.Rectangle {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || w == 0 || h == 0 {
+		return bounds
+	}
+
+	// crop size
+	cw, ch := w, h
+	if w*height > h*width {
+		cw = h * width / height
+	} else {
+		ch = w * height / width
+	}
+	if cw == w && ch == h {
+		return bounds
+	}
+
+	step := w
+	if h > step {
+		step = h
+	}
+	step = (step + smartCropGridSize - 1) / smartCropGridSize
+	energy := edgeEnergy(img, step)
+
+	// sum energy along the fixed axis
+	horizontal := cw < w
+	lines := make([]float64, len(energy))
+	if horizontal {
+		lines = make([]float64, len(energy[0]))
+	}
+	for y := range energy {
+		for x := range energy[y] {
+			if horizontal {
+				lines[x] += energy[y][x]
+			} else {
+				lines[y] += energy[y][x]
+			}
+		}
+	}
+
+	free, size := h-ch, ch
+	if horizontal {
+		free, size = w-cw, cw
+	}
+	window := size / step
+	if window < 1 {
+		window = 1
+	}
+
+	sum := func(offset int) (score float64) {
+		if offset+window > len(lines) {
+			offset = len(lines) - window
+		}
+		for _, v := range lines[offset : offset+window] {
+			score += v
+		}
+		return
+	}
+
+	// keep the centered crop unless another position is more salient
+	pos := free / 2
+	bestScore := sum(pos / step)
+	for offset := 0; offset+window <= len(lines); offset++ {
+		if score := sum(offset); score > bestScore {
+			pos, bestScore = offset*step, score
+		}
+	}
+	if pos > free {
+		pos = free
+	}
+	if horizontal {
+		return image.Rect(bounds.Min.X+pos, bounds.Min.Y, bounds.Min.X+pos+cw, bounds.Max.Y)
+	}
+	return image.Rect(bounds.Min.X, bounds.Min.Y+pos, bounds.Max.X, bounds.Min.Y+pos+ch)
+}
+
+// Calculate gradient magnitude of luminance for every "step" pixels.
+func edgeEnergy(img image.Image, step int) [][]float64 {
+	bounds := img.Bounds()
+	gw := (bounds.Dx() + step - 1) / step
+	gh := (bounds.Dy() + step - 1) / step
+
+	gray := make([][]float64, gh)
+	for y := 0; y < gh; y++ {
+		gray[y] = make([]float64, gw)
+		for x := 0; x < gw; x++ {
+			c := color.GrayModel.Convert(img.At(bounds.Min.X+x*step, bounds.Min.Y+y*step)).(color.Gray)
+			gray[y][x] = float64(c.Y)
+		}
+	}
+
+	energy := make([][]float64, gh)
+	for y := 0; y < gh; y++ {
+		energy[y] = make([]float64, gw)
+		for x := 0; x < gw; x++ {
+			var dx, dy float64
+			if x+1 < gw {
+				dx = gray[y][x+1] - gray[y][x]
+			}
+			if y+1 < gh {
+				dy = gray[y+1][x] - gray[y][x]
+			}
+			energy[y][x] = math.Abs(dx) + math.Abs(dy)
+		}
+	}
+	return energy
+}
+
+// Get the mask of the most salient square of the image.
+func smartCropMask(img image.Image) []int {
+	rect := smartCrop(img, 1, 1)
+	return []int{rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+type SmartCropSuiteTester struct {
+	BaseSuite
+}
+
+// Test cropping of a wide image with a salient detail on the right side
+func (suite *SmartCropSuiteTester) TestWideImage() {
+	// GIVEN plain white wide image
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.White}, image.ZP, draw.Src)
+	// AND black square near the right edge
+	draw.Draw(img, image.Rect(240, 40, 260, 60), &image.Uniform{color.Black}, image.ZP, draw.Src)
+
+	// WHEN I find the square crop
+	rect := smartCrop(img, 1, 1)
+	// THEN crop should be square with full height
+	suite.Equal(100, rect.Dx())
+	suite.Equal(100, rect.Dy())
+	// AND crop should contain the black square
+	suite.True(image.Rect(240, 40, 260, 60).In(rect), rect.String())
+}
+
+// Test cropping of a plain tall image
+func (suite *SmartCropSuiteTester) TestPlainTallImage() {
+	// GIVEN plain tall image
+	img := image.NewGray(image.Rect(0, 0, 50, 150))
+
+	// WHEN I find the square crop
+	rect := smartCrop(img, 1, 1)
+	// THEN crop should be centered
+	suite.Equal(image.Rect(0, 50, 50, 100), rect)
+}
+
+// Test cropping of a square image
+func (suite *SmartCropSuiteTester) TestSquareImage() {
+	// GIVEN square image
+	img := image.NewGray(image.Rect(0, 0, 80, 80))
+
+	// WHEN I get the crop mask
+	mask := smartCropMask(img)
+	// THEN mask should cover the whole image
+	suite.Equal([]int{0, 0, 80, 80}, mask)
+}
+
+// TestRunSmartCropSuite will be run by the 'go test' command
+func TestRunSmartCropSuite(t *testing.T) {
+	Run(t, new(SmartCropSuiteTester))
+}
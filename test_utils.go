@@ -42,10 +42,14 @@ func (suite *BaseSuiteWithDB) InitSuite() {
 	fmt.Println("Database initialization")
 	config.SetPrefix("TEST_")
 	config.Parse("test.conf")
-	suite.session = getSession()
+	session, err := getSession()
+	if err != nil {
+		panic(err)
+	}
+	suite.session = session
 	suite.db = suite.session.DB(*MongoDatabase)
 	// remove old test database if exists
-	err := suite.db.DropDatabase()
+	err = suite.db.DropDatabase()
 	if err != nil {
 		suite.T().Error(err.Error())
 	}
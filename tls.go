@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/drone/config"
+	"github.com/zenazn/goji/web"
+)
+
+var (
+	TlsCertFile          = config.String("tls-cert-file", "")
+	TlsKeyFile           = config.String("tls-key-file", "")
+	TlsReloadInterval    = config.Duration("tls-reload-interval", 30*time.Second)
+	TlsClientCaFile      = config.String("tls-client-ca-file", "")
+	TlsRequireClientCert = config.Bool("tls-require-client-cert", false)
+)
+
+// certReloader loads the certificate again when its files are modified, so
+// rotated certificates are served without restart. Files are checked at most
+// once per interval.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, interval time.Duration) (*certReloader, error) {
+	l := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	if err := l.reload(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Load the certificate if any of its files is modified.
+func (l *certReloader) reload(now time.Time) error {
+	l.checked = now
+	modTime, err := latestModTime(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	if l.cert != nil && !modTime.After(l.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert, l.modTime = &cert, modTime
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. The previous
+// certificate is kept if the new one can't be loaded, e.g. while the
+// certificate is written but the key is not yet.
+func (l *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now := time.Now(); now.Sub(l.checked) >= l.interval {
+		if err := l.reload(now); err != nil {
+			logger.Warn("certificate is not reloaded", "error", err)
+		}
+	}
+	return l.cert, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Build TLS configuration from "tls-cert-file" and "tls-key-file". Returns
+// nil if TLS is not configured. Client certificates signed by the CAs of
+// "tls-client-ca-file" are verified if given. HTTP/2 is negotiated by ALPN.
+// Should be called after the configuration is parsed.
+func initTLS() (*tls.Config, error) {
+	if *TlsRequireClientCert && *TlsClientCaFile == "" {
+		return nil, errors.New(`"tls-require-client-cert" requires "tls-client-ca-file"`)
+	}
+	if *TlsCertFile == "" && *TlsKeyFile == "" {
+		if *TlsClientCaFile != "" {
+			return nil, errors.New(`"tls-client-ca-file" requires "tls-cert-file" and "tls-key-file"`)
+		}
+		return nil, nil
+	}
+	reloader, err := newCertReloader(*TlsCertFile, *TlsKeyFile, *TlsReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if *TlsClientCaFile != "" {
+		data, err := ioutil.ReadFile(*TlsClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New(`"tls-client-ca-file" contains no certificates`)
+		}
+		tlsConfig.ClientCAs = pool
+		// reading stays public, so certificates are required by RequireClientCert for writes only
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// Get the verified client certificate of the request if any.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// RequireClientCert rejects writing requests without verified client
+// certificate if "tls-require-client-cert" is enabled.
+func RequireClientCert(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *TlsRequireClientCert && !isReadRequest(r) && clientCertificate(r) == nil {
+			JsonResponseMsg(w, http.StatusForbidden, `client certificate required`)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+type TlsSuiteTester struct {
+	BaseSuite
+
+	dir    string
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+}
+
+// Settings for suite
+func (suite *TlsSuiteTester) SetupSuite() {
+	// INIT temporary directory for certificates
+	dir, err := ioutil.TempDir("", "avatars-tls")
+	if err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	suite.dir = dir
+	// AND self-signed CA
+	suite.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "avatars test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &suite.caKey.PublicKey, suite.caKey)
+	if err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	suite.caCert, _ = x509.ParseCertificate(der)
+	suite.writePem("ca.pem", "CERTIFICATE", der)
+}
+
+// Remove certificates after suite
+func (suite *TlsSuiteTester) TearDownSuite() {
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *TlsSuiteTester) writePem(name string, blockType string, der []byte) string {
+	path := filepath.Join(suite.dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	return path
+}
+
+// Issue certificate signed by the CA and write it with its key into files.
+func (suite *TlsSuiteTester) issue(name string, serial int64, usage x509.ExtKeyUsage) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, suite.caCert, &key.PublicKey, suite.caKey)
+	if err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	return suite.writePem(name+".pem", "CERTIFICATE", der), suite.writePem(name+"-key.pem", "EC PRIVATE KEY", keyDer)
+}
+
+// Test reloading of the rotated certificate
+func (suite *TlsSuiteTester) TestCertReload() {
+	// GIVEN reloader of the server certificate
+	certFile, keyFile := suite.issue("server", 2, x509.ExtKeyUsageServerAuth)
+	reloader, err := newCertReloader(certFile, keyFile, 0)
+	suite.Nil(err)
+	first, _ := reloader.GetCertificate(nil)
+
+	// WHEN the certificate is rotated
+	suite.issue("server", 3, x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	// THEN the new certificate should be served
+	second, _ := reloader.GetCertificate(nil)
+	suite.NotEqual(first.Certificate[0], second.Certificate[0])
+
+	// WHEN the key is broken
+	ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	// THEN the previous certificate should be kept
+	third, _ := reloader.GetCertificate(nil)
+	suite.Equal(second, third)
+}
+
+// Test HTTP/2 and client certificates of writing requests
+func (suite *TlsSuiteTester) TestClientCert() {
+	// GIVEN server requiring client certificates for writing
+	certFile, keyFile := suite.issue("server", 4, x509.ExtKeyUsageServerAuth)
+	clientCertFile, clientKeyFile := suite.issue("client", 5, x509.ExtKeyUsageClientAuth)
+	defer func(cert, key, ca string, require bool) {
+		*TlsCertFile, *TlsKeyFile, *TlsClientCaFile, *TlsRequireClientCert = cert, key, ca, require
+	}(*TlsCertFile, *TlsKeyFile, *TlsClientCaFile, *TlsRequireClientCert)
+	*TlsCertFile, *TlsKeyFile = certFile, keyFile
+	*TlsClientCaFile = filepath.Join(suite.dir, "ca.pem")
+	*TlsRequireClientCert = true
+
+	tlsConfig, err := initTLS()
+	if err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	mux := web.New()
+	mux.Use(RequireClientCert)
+	mux.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(clientCertificate(r).Subject.CommonName))
+	})
+	server := newServer(mux)
+	server.TLSConfig = tlsConfig
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- runServer(server, l, stop)
+	}()
+	defer func() {
+		stop <- syscall.SIGTERM
+		<-stopped
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(suite.caCert)
+	post := func(certificates []tls.Certificate) *http.Response {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certificates},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Post("https://"+l.Addr().String()+"/", "text/plain", nil)
+		if err != nil {
+			suite.T().Fatal(err.Error())
+		}
+		return resp
+	}
+
+	// WHEN I write without client certificate
+	resp := post(nil)
+	resp.Body.Close()
+	// THEN access should be forbidden
+	suite.Equal(http.StatusForbidden, resp.StatusCode)
+
+	// WHEN I write with client certificate
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		suite.T().Fatal(err.Error())
+	}
+	resp = post([]tls.Certificate{clientCert})
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// THEN the request should be served over HTTP/2
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	suite.Equal(2, resp.ProtoMajor)
+	// AND the client should be identified
+	suite.Equal("client", string(body))
+}
+
+// Test requiring client certificates without CA
+func (suite *TlsSuiteTester) TestRequireClientCertWithoutCa() {
+	// GIVEN required client certificates without CA to verify them
+	certFile, keyFile := suite.issue("server", 6, x509.ExtKeyUsageServerAuth)
+	defer func(cert, key string, require bool) {
+		*TlsCertFile, *TlsKeyFile, *TlsRequireClientCert = cert, key, require
+	}(*TlsCertFile, *TlsKeyFile, *TlsRequireClientCert)
+	*TlsCertFile, *TlsKeyFile = certFile, keyFile
+	*TlsRequireClientCert = true
+
+	// WHEN I load TLS settings
+	_, err := initTLS()
+	// THEN loading should fail
+	suite.NotNil(err)
+}
+
+// TestRunTlsSuite will be run by the 'go test' command
+func TestRunTlsSuite(t *testing.T) {
+	Run(t, new(TlsSuiteTester))
+}
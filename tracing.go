@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/drone/config"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/mutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	TracingExporter     = config.String("tracing-exporter", "")
+	TracingOtlpEndpoint = config.String("tracing-otlp-endpoint", "")
+	TracingOtlpInsecure = config.Bool("tracing-otlp-insecure", false)
+	TracingServiceName  = config.String("tracing-service-name", "avatars")
+	TracingSampleRatio  = config.Float64("tracing-sample-ratio", 1)
+)
+
+const (
+	// Export spans to OTLP collector over HTTP.
+	TracingOtlp = "otlp"
+	// Print spans to stdout for local testing.
+	TracingStdout = "stdout"
+
+	tracerName = "github.com/antonikonovalov/avatars"
+)
+
+// Set up W3C trace context propagation and the exporter of "tracing-exporter":
+// "otlp", "stdout" or none. Spans are not recorded without an exporter, but
+// incoming trace context is still propagated. Returns the function which
+// flushes the spans on shutdown. Should be called after the configuration
+// is parsed.
+func initTracing() (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch *TracingExporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case TracingOtlp:
+		var options []otlptracehttp.Option
+		if *TracingOtlpEndpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(*TracingOtlpEndpoint))
+		}
+		if *TracingOtlpInsecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case TracingStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, errors.New(`"tracing-exporter" should be "otlp" or "stdout"`)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", *TracingServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*TracingSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Get the tracer of the global provider.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Record the error in the span and end it. Not found results are not errors.
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != mgo.ErrNotFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Tracing starts the server span of the request. Parent trace context is
+// taken from "traceparent" header.
+func Tracing(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeLabel(r.URL.Path)
+		ctx, span := tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("request.id", GetRequestId(*c)),
+			),
+		)
+		defer span.End()
+
+		ww := mutil.WrapWriter(w)
+		h.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+	})
+}
+
+// Start the span of the storage operation. The returned function ends the
+// span and observes the operation metrics, it should be deferred with the
+// pointer to the returned error.
+func startStorageOperation(ctx context.Context, operation string) (context.Context, func(*error)) {
+	start := time.Now()
+	ctx, span := tracer().Start(ctx, "storage."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "mongodb")),
+	)
+	return ctx, func(err *error) {
+		observeStorage(operation, start, err)
+		endSpan(span, *err)
+	}
+}
+
+// Start the span of the image processing step. The returned function ends
+// the span and observes the step duration.
+func startProcessing(ctx context.Context, step string) func(error) {
+	start := time.Now()
+	_, span := tracer().Start(ctx, "image."+step)
+	return func(err error) {
+		observeProcessing(step, start)
+		endSpan(span, err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type TracingSuiteTester struct {
+	BaseSuite
+
+	mux      *web.Mux
+	recorder *tracetest.SpanRecorder
+}
+
+// Settings for suite
+func (suite *TracingSuiteTester) SetupSuite() {
+	// INIT router with "Tracing" middleware and handler with processing step
+	suite.mux = web.New()
+	suite.mux.Use(Tracing)
+	suite.mux.Get(BaseApiUrl+"file/:id", func(w http.ResponseWriter, r *http.Request) {
+		end := startProcessing(r.Context(), "resize")
+		end(nil)
+		JsonResponseMsg(w, http.StatusInternalServerError, `failure`)
+	})
+}
+
+// Settings for each test
+func (suite *TracingSuiteTester) SetupTest() {
+	// INIT record spans in memory
+	suite.recorder = tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(suite.recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// Test spans of the request with incoming trace context
+func (suite *TracingSuiteTester) TestTracing() {
+	// GIVEN trace context of the caller
+	traceId := "4bf92f3577b34a4e9a2aff7d0c8c1f8a"
+	parentId := "00f067aa0ba902b7"
+
+	// WHEN I send request with "traceparent" header
+	r, err := http.NewRequest("GET", BaseApiUrl+"file/d41d8cd98f00b204e9800998ecf8427e", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	r.Header.Set("traceparent", "00-"+traceId+"-"+parentId+"-01")
+	suite.mux.ServeHTTP(httptest.NewRecorder(), r)
+
+	// THEN server span and processing span should be recorded
+	spans := suite.recorder.Ended()
+	suite.Len(spans, 2)
+	step, server := spans[0], spans[1]
+	suite.Equal("image.resize", step.Name())
+	suite.Equal("GET "+BaseApiUrl+"file/:id", server.Name())
+	// AND they should continue the trace of the caller
+	suite.Equal(traceId, server.SpanContext().TraceID().String())
+	suite.Equal(parentId, server.Parent().SpanID().String())
+	suite.Equal(server.SpanContext().SpanID(), step.Parent().SpanID())
+	// AND server error should be recorded
+	suite.Equal(codes.Error, server.Status().Code)
+	suite.Contains(server.Attributes(), attribute.Int("http.response.status_code", http.StatusInternalServerError))
+}
+
+// Test configuration of the exporter
+func (suite *TracingSuiteTester) TestInitTracing() {
+	exporter := *TracingExporter
+	defer func() { *TracingExporter = exporter }()
+
+	// WHEN I set unknown exporter
+	*TracingExporter = "zipkin"
+	_, err := initTracing()
+	// THEN error should be raised
+	suite.Error(err)
+
+	// WHEN I set stdout exporter
+	*TracingExporter = TracingStdout
+	shutdown, err := initTracing()
+	// THEN there should be no error
+	suite.Nil(err)
+	suite.Nil(shutdown(context.Background()))
+}
+
+// TestRunTracingSuite will be run by the 'go test' command
+func TestRunTracingSuite(t *testing.T) {
+	Run(t, new(TracingSuiteTester))
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"image"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -10,16 +12,65 @@ import (
 
 const MaxFileSize = 10 * 1024 * 1024 // 10 MB
 
-// Check whether the file size is acceptable.
-func checkFileSize(r io.Reader) error {
-	data, err := ioutil.ReadAll(io.LimitReader(r, MaxFileSize+1))
-	if err != nil {
-		return err
+var ErrFileTooLarge = errors.New(`CONTENT_LENGTH_TOO_LARGE`)
+
+// sizeLimitReader fails with ErrFileTooLarge as soon as more than "n" bytes
+// are read from the underlying reader.
+type sizeLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func newSizeLimitReader(r io.Reader, n int64) io.Reader {
+	return &sizeLimitReader{r: r, n: n}
+}
+
+func (l *sizeLimitReader) Read(p []byte) (n int, err error) {
+	if l.n < 0 {
+		return 0, ErrFileTooLarge
+	}
+	// read one byte over the limit to know that it is exceeded
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrFileTooLarge
 	}
-	if len(data) > MaxFileSize {
-		return errors.New(`CONTENT_LENGTH_TOO_LARGE`)
+	return
+}
+
+// contextReader fails with the context error as soon as the context is
+// done, so long reads are aborted when the request is canceled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
 	}
-	return nil
+	return c.r.Read(p)
+}
+
+// contextResponseWriter fails to write the body as soon as the context is
+// done, so encoding of the image into response is aborted.
+type contextResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w *contextResponseWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.Write(p)
 }
 
 // Check whether a string slice contains a certain value.
@@ -32,6 +83,17 @@ func contains(slice []string, value string) bool {
 	return false
 }
 
+// Crop the image with the given rectangle.
+func cropImage(img image.Image, rect image.Rectangle) (image.Image, error) {
+	pic, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		return nil, errors.New(`can't convert image`)
+	}
+	return pic.SubImage(rect), nil
+}
+
 // Get content type of file if set. Otherwise returns "application/octet-stream".
 func getFileType(file io.Reader) (array []byte, filetype string, err error) {
 	if array, err = ioutil.ReadAll(file); err != nil {
@@ -45,6 +107,10 @@ func getFileType(file io.Reader) (array []byte, filetype string, err error) {
 // JSON struct: {"msg": "some message"}
 func JsonResponseMsg(w http.ResponseWriter, status int, msg string) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	setNoCacheHeaders(w.Header())
+	if status >= http.StatusBadRequest {
+		setErrorCause(w, msg)
+	}
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(map[string]string{"msg": msg}); err != nil {
 		panic(err)
@@ -54,12 +120,34 @@ func JsonResponseMsg(w http.ResponseWriter, status int, msg string) {
 
 // Write JSON-response with given status code and struct object.
 func JsonResponseFromStruct(w http.ResponseWriter, status int, avatar *Avatar) {
+	JsonResponse(w, status, avatar)
+	return
+}
+
+// Write JSON-response with given status code and any value.
+func JsonResponse(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	setNoCacheHeaders(w.Header())
 	w.WriteHeader(status)
-	jsonString, err := json.Marshal(avatar)
+	jsonString, err := json.Marshal(v)
 	if err != nil {
 		panic(err)
 	}
 	w.Write(jsonString)
 	return
 }
+
+// Write JSON-response with the error message. Requests which hit their
+// deadline get "504 Gateway Timeout", nothing is written to the clients
+// which have gone away.
+func JsonResponseError(w http.ResponseWriter, status int, err error) {
+	switch err {
+	case context.DeadlineExceeded:
+		JsonResponseMsg(w, http.StatusGatewayTimeout, `request timeout`)
+	case context.Canceled:
+		setErrorCause(w, err.Error())
+	default:
+		JsonResponseMsg(w, status, err.Error())
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+type UtilsSuiteTester struct {
+	BaseSuite
+}
+
+// Test reading within the size limit
+func (suite *UtilsSuiteTester) TestSizeLimitReader() {
+	// GIVEN reader of 10 bytes limited to 10 bytes
+	reader := newSizeLimitReader(bytes.NewReader(make([]byte, 10)), 10)
+
+	// WHEN I read all the data
+	data, err := ioutil.ReadAll(reader)
+	// THEN there should be no error
+	suite.Nil(err)
+	suite.Equal(10, len(data))
+}
+
+// Test reading over the size limit
+func (suite *UtilsSuiteTester) TestSizeLimitReaderExceeded() {
+	// GIVEN reader of 11 bytes limited to 10 bytes
+	reader := newSizeLimitReader(bytes.NewReader(make([]byte, 11)), 10)
+
+	// WHEN I read all the data
+	_, err := ioutil.ReadAll(reader)
+	// THEN "too large" error should be raised
+	suite.Equal(ErrFileTooLarge, err)
+}
+
+// Test uploading file of unsupported type
+func (suite *UtilsSuiteTester) TestStoreUnsupportedFile() {
+	// WHEN I store the text file
+	_, status, err := storeUploadedFile(context.Background(), strings.NewReader("plain text"), "file.txt")
+	// THEN "unsupported media type" error should be raised before storing
+	suite.Equal(http.StatusUnsupportedMediaType, status)
+	suite.Equal(`UNSUPPORTED_MEDIA_TYPE`, err.Error())
+}
+
+// Test reading with canceled context
+func (suite *UtilsSuiteTester) TestContextReader() {
+	// GIVEN reader of the context
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := newContextReader(ctx, bytes.NewReader(make([]byte, 10)))
+
+	// WHEN I read the data before cancellation
+	data := make([]byte, 5)
+	n, err := reader.Read(data)
+	// THEN there should be no error
+	suite.Nil(err)
+	suite.Equal(5, n)
+
+	// WHEN I read the rest after cancellation
+	cancel()
+	_, err = reader.Read(data)
+	// THEN "canceled" error should be raised
+	suite.Equal(context.Canceled, err)
+}
+
+// Test responding to the request which hits its deadline
+func (suite *UtilsSuiteTester) TestTimeout() {
+	// GIVEN router with "Timeout" middleware and handler waiting for the storage
+	timeout := *RequestTimeout
+	defer func() { *RequestTimeout = timeout }()
+	*RequestTimeout = 10 * time.Millisecond
+	mux := web.New()
+	mux.Use(Timeout)
+	mux.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		JsonResponseError(w, http.StatusInternalServerError, r.Context().Err())
+	})
+
+	// WHEN I send request
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		suite.T().Error(err.Error())
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	// THEN "gateway timeout" should be responded
+	suite.Equal(http.StatusGatewayTimeout, w.Code)
+	suite.Contains(w.Body.String(), "request timeout")
+}
+
+// TestRunUtilsSuite will be run by the 'go test' command
+func TestRunUtilsSuite(t *testing.T) {
+	Run(t, new(UtilsSuiteTester))
+}